@@ -0,0 +1,259 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Topic describes a topic
+type Topic struct {
+	Name string `json:"name"`
+	// Id of the last message published
+	Offset  int64 `json:"offset"`
+	Persist bool  `json:"persist"`
+	// Number of messages kept in memory
+	Buffered int `json:"buffered"`
+	// Next offset fetched per consumer group
+	Groups      map[string]int64 `json:"groups"`
+	Subscribers []*Subscriber    `json:"subscribers"`
+}
+
+// Subscriber describes a subscriber
+type Subscriber struct {
+	Id       string            `json:"id"`
+	Metadata map[string]string `json:"metadata"`
+	Created  time.Time         `json:"created"`
+	// Messages waiting to be received
+	Buffer   int   `json:"buffer"`
+	Capacity int   `json:"capacity"`
+	Dropped  int64 `json:"dropped"`
+}
+
+// describe returns the topic description. Must be called with the broker locked.
+func (t *topic) describe() *Topic {
+	t.Lock()
+	info := &Topic{
+		Name:     t.name,
+		Offset:   t.offset,
+		Persist:  t.store != nil,
+		Buffered: len(t.buffer),
+		Groups:   make(map[string]int64),
+	}
+	for g, o := range t.groups {
+		info.Groups[g] = o
+	}
+	t.Unlock()
+
+	info.Subscribers = []*Subscriber{}
+
+	for _, sub := range t.subscribers {
+		md := sub.metadata
+		if md == nil {
+			md = map[string]string{}
+		}
+		info.Subscribers = append(info.Subscribers, &Subscriber{
+			Id:       sub.id,
+			Metadata: md,
+			Created:  sub.created,
+			Buffer:   len(sub.ch),
+			Capacity: cap(sub.ch),
+			Dropped:  atomic.LoadInt64(&sub.dropped),
+		})
+	}
+
+	return info
+}
+
+// Topics returns a description of every topic
+func (b *broker) Topics() ([]*Topic, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	topics := []*Topic{}
+	for _, t := range b.topics {
+		topics = append(topics, t.describe())
+	}
+
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+
+	return topics, nil
+}
+
+// Describe returns a description of the topic
+func (b *broker) Describe(topic string) (*Topic, error) {
+	b.RLock()
+	defer b.RUnlock()
+
+	t, ok := b.topics[topic]
+	if !ok {
+		return nil, fmt.Errorf("topic %s not found", topic)
+	}
+
+	return t.describe(), nil
+}
+
+// Kick removes the subscriber closing its channel
+func (b *broker) Kick(topic, id string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	t, ok := b.topics[topic]
+	if !ok {
+		return fmt.Errorf("topic %s not found", topic)
+	}
+
+	var subs []*subscriber
+	var kicked bool
+
+	for _, sub := range t.subscribers {
+		if sub.id == id {
+			sub.close()
+			sub.log.Info("Subscriber kicked")
+			kicked = true
+			continue
+		}
+		subs = append(subs, sub)
+	}
+
+	if !kicked {
+		return fmt.Errorf("subscriber %s not found", id)
+	}
+
+	t.subscribers = subs
+	t.observe()
+	return nil
+}
+
+// Purge deletes the messages stored in memory and persisted for the topic
+func (b *broker) Purge(topic string) error {
+	if b.options.Proxy {
+		return errors.New("purge not supported by proxy")
+	}
+
+	b.RLock()
+	t, ok := b.topics[topic]
+	b.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("topic %s not found", topic)
+	}
+
+	t.fetch.Lock()
+	defer t.fetch.Unlock()
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.buffer = nil
+
+	// consumer groups continue from new messages
+	for g := range t.groups {
+		t.groups[g] = t.offset + 1
+	}
+	t.dirty = true
+
+	if t.store != nil {
+		if err := t.store.Truncate(); err != nil {
+			b.options.Logger.Error("Failed to truncate topic log", "topic", topic, "error", err)
+			return err
+		}
+	}
+
+	b.options.Logger.Info("Topic purged", "topic", topic)
+	return nil
+}
+
+// Delete closes the subscribers of the topic and deletes its messages
+func (b *broker) Delete(topic string) error {
+	if b.options.Proxy {
+		return errors.New("delete not supported by proxy")
+	}
+
+	b.Lock()
+	t, ok := b.topics[topic]
+	if ok {
+		for _, sub := range t.subscribers {
+			sub.close()
+		}
+		t.subscribers = nil
+		delete(b.topics, topic)
+	}
+	b.Unlock()
+
+	if !ok {
+		return fmt.Errorf("topic %s not found", topic)
+	}
+
+	active.Delete(t.namespace, t.name)
+	depth.Delete(t.namespace, t.name)
+
+	t.fetch.Lock()
+	defer t.fetch.Unlock()
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.buffer = nil
+	// wake up waiting fetches
+	if t.notify != nil {
+		close(t.notify)
+		t.notify = nil
+	}
+
+	if t.store != nil {
+		err := t.store.Remove()
+		t.store = nil
+		if err != nil {
+			b.options.Logger.Error("Failed to delete topic log", "topic", topic, "error", err)
+			return err
+		}
+	}
+
+	b.options.Logger.Info("Topic deleted", "topic", topic)
+	return nil
+}
+
+// SetPersist enables or disables persistence for the topic
+func (b *broker) SetPersist(topic string, persist bool) error {
+	if b.options.Proxy {
+		return errors.New("persistence not supported by proxy")
+	}
+
+	if err := validate(topic); err != nil {
+		return err
+	}
+
+	t, err := b.topic(topic)
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	switch {
+	case persist && t.store == nil:
+		s, offset, err := newStore(b.path(topic))
+		if err != nil {
+			b.options.Logger.Error("Failed to open topic log", "topic", topic, "error", err)
+			return err
+		}
+		if offset > t.offset {
+			t.offset = offset
+		}
+		t.store = s
+		t.dirty = true
+		b.persisted()
+	case !persist && t.store != nil:
+		err := t.store.Close()
+		t.store = nil
+		return err
+	}
+
+	return nil
+}
@@ -1,44 +1,169 @@
 package broker
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/asim/emque/client"
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/trace"
 )
 
 var (
 	Default Broker = newBroker()
+
+	// Topic names may not contain path separators or ..
+	ErrInvalidTopic = errors.New("invalid topic")
 )
 
 // internal broker
 type broker struct {
 	exit    chan bool
 	options *Options
+	// closed once persisted topics are recovered
+	recovered chan bool
+
+	// held by publishes, locked on shutdown
+	pmtx    sync.RWMutex
+	closing bool
+	// in flight fan-outs
+	wg sync.WaitGroup
+	// starts flushing once a topic is persisted
+	flushing sync.Once
+
+	sync.RWMutex
+	topics map[string]*topic
+	// closed when a topic is created
+	created chan bool
+
+	mtx     sync.RWMutex
+	proxied map[<-chan *Message]*proxied
+	// message subscriptions of payload subscribers
+	payloads map[<-chan []byte]*payload
+}
+
+// payload subscription
+type payload struct {
+	ch <-chan *Message
+	// closed when unsubscribed
+	done chan bool
+}
+
+// internal topic
+type topic struct {
+	name      string
+	namespace string
+
+	// guards the offset and store
+	sync.Mutex
+	// id of the last message published
+	offset int64
+	// persisted log, nil if not persisted
+	store *store
+	// recent messages kept in memory once fetched
+	buffer  []*Message
+	fetched bool
+	// next offset to fetch per consumer group
+	groups map[string]int64
+	// groups changed since last persisted
+	dirty bool
+	// closed when a message is published
+	notify chan bool
+
+	// serialises fetches
+	fetch sync.Mutex
+
+	// guarded by the broker
+	subscribers []*subscriber
+}
 
+// internal subscriber
+type subscriber struct {
+	id       string
+	metadata map[string]string
+	created  time.Time
+	// messages dropped, accessed atomically
+	dropped int64
+	// time drops were last logged, accessed atomically
+	logged int64
+	log    logger.Logger
+	// namespace the metrics are labelled with
+	namespace string
+
+	// channel the broker publishes to
+	ch chan *Message
+	// channel returned to the caller
+	out  <-chan *Message
+	exit chan bool
+
+	// guards closing the channel
 	sync.RWMutex
-	topics map[string][]chan []byte
+	closed bool
+}
 
-	mtx       sync.RWMutex
-	persisted map[string]bool
+// internal proxied subscriber
+type proxied struct {
+	ch   <-chan []byte
+	exit chan bool
 }
 
-// internal message for persistence
-type message struct {
+// Message is a message published to a topic
+type Message struct {
+	// Id is the sequence number of the message within the topic
+	Id        int64  `json:"id"`
 	Timestamp int64  `json:"timestamp"`
 	Topic     string `json:"topic"`
 	Payload   []byte `json:"payload"`
+	// Headers such as the trace context
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 // Broker is the message broker
 type Broker interface {
 	Close() error
-	Publish(topic string, payload []byte) error
+	// Shutdown stops publishing and waits for subscribers to
+	// drain their buffers until the context is done then closes
+	Shutdown(ctx context.Context) error
+	Publish(topic string, payload []byte, opts ...PublishOption) error
 	Subscribe(topic string) (<-chan []byte, error)
 	Unsubscribe(topic string, sub <-chan []byte) error
+	// SubscribeMessages subscribes to messages with their id, timestamp and headers
+	SubscribeMessages(topic string, opts ...SubscribeOption) (<-chan *Message, error)
+	UnsubscribeMessages(topic string, sub <-chan *Message) error
+	Fetch(topic string, opts ...FetchOption) ([]*Message, error)
+	Topics() ([]*Topic, error)
+	Describe(topic string) (*Topic, error)
+	Kick(topic, id string) error
+	Purge(topic string) error
+	// Delete closes the subscribers of the topic and deletes its messages
+	Delete(topic string) error
+	// Commit sets the next offset fetched by the consumer group
+	Commit(topic, group string, offset int64) error
+	SetPersist(topic string, persist bool) error
+	// Ready returns an error if the broker cannot serve requests
+	Ready() error
+}
+
+// pinger is implemented by clients which check servers are reachable
+type pinger interface {
+	Ping() error
+}
+
+func newId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 func newBroker(opts ...Option) *broker {
@@ -51,18 +176,44 @@ func newBroker(opts ...Option) *broker {
 		options.Client = client.New()
 	}
 
-	return &broker{
+	if options.Buffer == 0 {
+		options.Buffer = 1000
+	}
+
+	if options.Tracer == nil {
+		options.Tracer = trace.Default
+	}
+
+	if options.Logger == nil {
+		options.Logger = logger.Default
+	}
+
+	if len(options.Namespace) == 0 {
+		options.Namespace = "default"
+	}
+
+	b := &broker{
 		exit:      make(chan bool),
 		options:   options,
-		topics:    make(map[string][]chan []byte),
-		persisted: make(map[string]bool),
+		recovered: make(chan bool),
+		topics:    make(map[string]*topic),
+		proxied:   make(map[<-chan *Message]*proxied),
+		payloads:  make(map[<-chan []byte]*payload),
 	}
+
+	go b.recover()
+
+	return b
 }
 
-func (b *broker) publish(payload []byte, subscribers []chan []byte) {
+func (b *broker) publish(ctx context.Context, msg *Message, subscribers []*subscriber) {
 	n := len(subscribers)
 	c := 1
 
+	_, span := b.options.Tracer.Start(ctx, "fanout")
+	span.SetAttribute("topic", msg.Topic)
+	span.SetAttribute("subscribers", strconv.Itoa(n))
+
 	// increase concurrency if there are many subscribers
 	switch {
 	case n > 1000:
@@ -71,16 +222,21 @@ func (b *broker) publish(payload []byte, subscribers []chan []byte) {
 		c = 2
 	}
 
+	// the last publisher ends the span
+	remaining := int32(c)
+	b.wg.Add(c)
+
 	// publisher function
 	pub := func(start int) {
+		defer func() {
+			if atomic.AddInt32(&remaining, -1) == 0 {
+				span.End()
+			}
+			b.wg.Done()
+		}()
 		// iterate the subscribers
 		for j := start; j < n; j += c {
-			select {
-			// push the payload to subscriber
-			case subscribers[j] <- payload:
-			// only wait 5 milliseconds for subscriber
-			case <-time.After(time.Millisecond * 5):
-			case <-b.exit:
+			if !subscribers[j].send(msg, b.exit) {
 				return
 			}
 		}
@@ -92,59 +248,307 @@ func (b *broker) publish(payload []byte, subscribers []chan []byte) {
 	}
 }
 
-func (b *broker) persist(topic string) error {
-	b.mtx.Lock()
-	defer b.mtx.Unlock()
+// send pushes the message to the subscriber. It
+// returns false if the broker is closed.
+func (s *subscriber) send(msg *Message, exit chan bool) bool {
+	s.RLock()
+	defer s.RUnlock()
 
-	if b.persisted[topic] {
-		return nil
+	if s.closed {
+		return true
 	}
 
-	ch, err := b.Subscribe(topic)
+	select {
+	// push the payload to subscriber
+	case s.ch <- msg:
+		delivered.Inc(s.namespace, msg.Topic)
+		bytesOut.Add(float64(len(msg.Payload)), s.namespace, msg.Topic)
+	// only wait 5 milliseconds for subscriber
+	case <-time.After(time.Millisecond * 5):
+		n := atomic.AddInt64(&s.dropped, 1)
+		dropped.Inc(s.namespace, msg.Topic)
+		// log at most once a second per subscriber
+		now := time.Now().UnixNano()
+		last := atomic.LoadInt64(&s.logged)
+		if now-last > int64(time.Second) && atomic.CompareAndSwapInt64(&s.logged, last, now) {
+			s.log.Warn("Dropping messages for slow subscriber", "dropped", n)
+		}
+	case <-exit:
+		return false
+	}
+
+	return true
+}
+
+// close closes the subscriber channel
+func (s *subscriber) close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	close(s.exit)
+	close(s.ch)
+}
+
+// persisted starts flushing persisted topics
+func (b *broker) persisted() {
+	b.flushing.Do(func() {
+		go b.flush()
+	})
+}
+
+// flush periodically writes persisted messages to disk
+func (b *broker) flush() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	type flush struct {
+		t      *topic
+		s      *store
+		groups map[string]int64
+	}
+
+	for {
+		select {
+		case <-tick.C:
+		case <-b.exit:
+			return
+		}
+
+		// collect the stores so the disk is not written under lock
+		var flushes []flush
+
+		b.RLock()
+		for _, t := range b.topics {
+			t.Lock()
+			if t.store != nil {
+				f := flush{t: t, s: t.store}
+				if t.dirty {
+					f.groups = make(map[string]int64, len(t.groups))
+					for k, v := range t.groups {
+						f.groups[k] = v
+					}
+					t.dirty = false
+				}
+				flushes = append(flushes, f)
+			}
+			t.Unlock()
+		}
+		b.RUnlock()
+
+		for _, f := range flushes {
+			start := time.Now()
+			if err := f.s.Flush(); err != nil {
+				b.options.Logger.Error("Failed to write messages", "topic", f.t.name, "error", err)
+			}
+			writeLatency.Observe(time.Since(start).Seconds(), f.t.namespace, f.t.name)
+			if err := f.s.Sync(); err != nil {
+				fsyncErrors.Inc(f.t.namespace, f.t.name)
+				b.options.Logger.Error("Failed to sync messages", "topic", f.t.name, "error", err)
+			}
+			if f.groups != nil {
+				if err := f.s.SaveOffsets(f.groups); err != nil {
+					b.options.Logger.Error("Failed to save group offsets", "topic", f.t.name, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// validate returns an error if the topic name could escape the data directory
+func validate(topic string) error {
+	if len(topic) == 0 || strings.ContainsAny(topic, `/\`) || strings.Contains(topic, "..") {
+		return fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+	}
+	return nil
+}
+
+// path returns the path of the persisted topic log
+func (b *broker) path(topic string) string {
+	return filepath.Join(b.options.Dir, topic+".mq")
+}
+
+// recover opens the topics persisted in the directory
+func (b *broker) recover() {
+	defer close(b.recovered)
+
+	if !b.options.Persist || b.options.Proxy {
+		return
+	}
+
+	if len(b.options.Dir) > 0 {
+		if err := os.MkdirAll(b.options.Dir, 0770); err != nil {
+			b.options.Logger.Error("Failed to create data directory", "dir", b.options.Dir, "error", err)
+			return
+		}
+	}
+
+	files, err := filepath.Glob(b.path("*"))
 	if err != nil {
-		return err
+		return
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".mq")
+		if _, err := b.topic(name); err != nil {
+			continue
+		}
+		b.options.Logger.Debug("Recovered topic", "topic", name)
+	}
+
+	b.options.Logger.Info("Recovered persisted topics", "topics", len(files))
+}
+
+// topic returns the topic creating it if necessary
+func (b *broker) topic(name string) (*topic, error) {
+	b.RLock()
+	t, ok := b.topics[name]
+	b.RUnlock()
+	if ok {
+		return t, nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if t, ok := b.topics[name]; ok {
+		return t, nil
+	}
+
+	// topics are not created once closed
+	select {
+	case <-b.exit:
+		return nil, errors.New("broker closed")
+	default:
+	}
+
+	t = &topic{
+		name:      name,
+		namespace: b.options.Namespace,
+		groups:    make(map[string]int64),
+	}
+
+	// persist?
+	if b.options.Persist {
+		s, offset, err := newStore(b.path(name))
+		if err != nil {
+			b.options.Logger.Error("Failed to open topic log", "topic", name, "error", err)
+			return nil, err
+		}
+		groups, err := s.Offsets()
+		if err != nil {
+			b.options.Logger.Error("Failed to read group offsets", "topic", name, "error", err)
+			s.Close()
+			return nil, err
+		}
+		// ids never go backwards from committed
+		// group offsets e.g after a purge
+		for _, next := range groups {
+			if next-1 > offset {
+				offset = next - 1
+			}
+		}
+		t.store = s
+		t.offset = offset
+		t.groups = groups
+		b.persisted()
+	}
+
+	b.topics[name] = t
+
+	// wake up fetches waiting for the topic
+	if b.created != nil {
+		t.fetched = true
+		close(b.created)
+		b.created = nil
+	}
+
+	return t, nil
+}
+
+// replay sends persisted messages from the offset followed by live messages
+func (b *broker) replay(t *topic, sub *subscriber, out chan<- *Message, offset int64) {
+	defer close(out)
+
+	var last int64
+
+	t.Lock()
+	s := t.store
+	t.Unlock()
+
+	if s != nil {
+		s.Read(offset, func(m *Message) bool {
+			select {
+			case out <- m:
+				last = m.Id
+				return true
+			case <-sub.exit:
+				return false
+			}
+		})
+	}
+
+	for {
+		select {
+		case m, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			// skip messages already replayed
+			if m.Id <= last {
+				continue
+			}
+			select {
+			case out <- m:
+			case <-sub.exit:
+				return
+			}
+		case <-sub.exit:
+			return
+		}
 	}
+}
 
-	f, err := os.OpenFile(topic+".mq", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0660)
+func (b *broker) proxy(topic string) (<-chan *Message, error) {
+	ch, err := b.options.Client.Subscribe(topic)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	out := make(chan *Message, 100)
+	exit := make(chan bool)
+
 	go func() {
-		var pending []byte
-		newline := []byte{'\n'}
-		t := time.NewTicker(time.Second)
-		defer t.Stop()
-		defer f.Close()
+		defer close(out)
 
 		for {
 			select {
-			case p := <-ch:
-				b, err := json.Marshal(&message{
-					Timestamp: time.Now().UnixNano(),
-					Topic:     topic,
-					Payload:   p,
-				})
-				if err != nil {
-					continue
+			case p, ok := <-ch:
+				if !ok {
+					return
 				}
-				pending = append(pending, b...)
-				pending = append(pending, newline...)
-			case <-t.C:
-				if len(pending) == 0 {
-					continue
+				select {
+				case out <- &Message{Timestamp: time.Now().UnixNano(), Topic: topic, Payload: p}:
+				case <-exit:
+					return
 				}
-				f.Write(pending)
-				pending = nil
+			case <-exit:
+				return
 			case <-b.exit:
 				return
 			}
 		}
 	}()
 
-	b.persisted[topic] = true
+	b.mtx.Lock()
+	b.proxied[out] = &proxied{ch: ch, exit: exit}
+	b.mtx.Unlock()
 
-	return nil
+	return out, nil
 }
 
 func (b *broker) Close() error {
@@ -154,60 +558,361 @@ func (b *broker) Close() error {
 	default:
 		close(b.exit)
 		b.Lock()
-		b.topics = make(map[string][]chan []byte)
+		for _, t := range b.topics {
+			// subscribers see their channel closed
+			for _, sub := range t.subscribers {
+				sub.close()
+			}
+			t.subscribers = nil
+
+			t.Lock()
+			if t.store != nil {
+				// saved even if clean as a flush in progress is dropped
+				if t.dirty || len(t.groups) > 0 {
+					if err := t.store.SaveOffsets(t.groups); err != nil {
+						b.options.Logger.Error("Failed to save group offsets", "topic", t.name, "error", err)
+					}
+				}
+				if err := t.store.Close(); err != nil {
+					b.options.Logger.Error("Failed to close topic log", "topic", t.name, "error", err)
+				}
+			}
+			t.Unlock()
+			active.Delete(t.namespace, t.name)
+			depth.Delete(t.namespace, t.name)
+		}
+		b.topics = make(map[string]*topic)
 		b.Unlock()
 		b.options.Client.Close()
 	}
 	return nil
 }
 
-func (b *broker) Publish(topic string, payload []byte) error {
+// drained returns true if subscribers have no buffered messages
+func (b *broker) drained() bool {
+	b.RLock()
+	defer b.RUnlock()
+
+	for _, t := range b.topics {
+		for _, sub := range t.subscribers {
+			if len(sub.ch) > 0 || len(sub.out) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (b *broker) Shutdown(ctx context.Context) error {
+	// wait for publishes in progress and stop new ones
+	b.pmtx.Lock()
+	b.closing = true
+	b.pmtx.Unlock()
+
+	b.options.Logger.Info("Draining subscribers")
+
+	// wait for fan-outs in flight
+	done := make(chan bool)
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	tick := time.NewTicker(time.Millisecond * 10)
+	defer tick.Stop()
+
+	for !b.drained() {
+		select {
+		case <-ctx.Done():
+			b.options.Logger.Warn("Timed out draining subscribers")
+			return b.Close()
+		case <-tick.C:
+		}
+	}
+
+	return b.Close()
+}
+
+func (b *broker) Ready() error {
+	b.pmtx.RLock()
+	closing := b.closing
+	b.pmtx.RUnlock()
+
+	if closing {
+		return errors.New("broker shutting down")
+	}
+
 	select {
 	case <-b.exit:
 		return errors.New("broker closed")
 	default:
 	}
 
+	select {
+	case <-b.recovered:
+	default:
+		return errors.New("recovering persisted topics")
+	}
+
+	// check upstream servers are reachable
 	if b.options.Proxy {
+		if p, ok := b.options.Client.(pinger); ok {
+			return p.Ping()
+		}
+		return nil
+	}
+
+	if !b.options.Persist {
+		return nil
+	}
+
+	// check the data directory is writable
+	f, err := ioutil.TempFile(b.options.Dir, ".ready")
+	if err != nil {
+		return fmt.Errorf("data directory not writable: %v", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (b *broker) Publish(topic string, payload []byte, opts ...PublishOption) error {
+	select {
+	case <-b.exit:
+		return errors.New("broker closed")
+	default:
+	}
+
+	if err := validate(topic); err != nil {
+		return err
+	}
+
+	options := new(PublishOptions)
+	for _, o := range opts {
+		o(options)
+	}
+
+	if b.options.Proxy {
+		// cancelled with the request
+		if cc, ok := b.options.Client.(client.ContextClient); ok && options.Context != nil {
+			return cc.PublishContext(options.Context, topic, payload)
+		}
 		return b.options.Client.Publish(topic, payload)
 	}
 
-	b.RLock()
-	subscribers, ok := b.topics[topic]
-	b.RUnlock()
-	if !ok {
-		// persist?
-		if !b.options.Persist {
-			return nil
+	b.pmtx.RLock()
+	defer b.pmtx.RUnlock()
+
+	if b.closing {
+		return errors.New("broker shutting down")
+	}
+
+	t, err := b.topic(topic)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if _, ok := trace.FromContext(ctx); !ok {
+		ctx = trace.ExtractContext(ctx, options.Headers)
+	}
+
+	ctx, span := b.options.Tracer.Start(ctx, "publish")
+	defer span.End()
+	span.SetAttribute("topic", topic)
+
+	msg := &Message{
+		Timestamp: start.UnixNano(),
+		Topic:     topic,
+		Payload:   payload,
+	}
+
+	// deliveries continue the publish trace
+	if len(options.Headers) > 0 || span.Context().IsValid() {
+		msg.Headers = make(map[string]string, len(options.Headers))
+		for k, v := range options.Headers {
+			msg.Headers[k] = v
 		}
-		if err := b.persist(topic); err != nil {
+		trace.Inject(span.Context(), msg.Headers)
+	}
+
+	t.Lock()
+	t.offset++
+	msg.Id = t.offset
+	if t.store != nil {
+		if err := t.store.write(msg); err != nil {
+			t.Unlock()
+			span.SetError(err)
+			b.options.Logger.Error("Failed to persist message", "topic", topic, "error", err)
 			return err
 		}
 	}
+	// buffer for fetch once the topic is fetched
+	if options.Buffered {
+		t.fetched = true
+	}
+	if t.fetched {
+		t.buffer = append(t.buffer, msg)
+		if len(t.buffer) > b.options.Buffer {
+			t.buffer = t.buffer[len(t.buffer)-b.options.Buffer:]
+		}
+	}
+	// wake up waiting fetches
+	if t.notify != nil {
+		close(t.notify)
+		t.notify = nil
+	}
+	t.Unlock()
+
+	b.RLock()
+	subscribers := t.subscribers
+	b.RUnlock()
+
+	b.publish(ctx, msg, subscribers)
+
+	b.RLock()
+	t.observe()
+	b.RUnlock()
+
+	published.Inc(b.options.Namespace, topic)
+	bytesIn.Add(float64(len(payload)), b.options.Namespace, topic)
+	publishLatency.Observe(time.Since(start).Seconds(), b.options.Namespace, topic)
 
-	b.publish(payload, subscribers)
 	return nil
 }
 
+// Subscribe subscribes to the payloads of messages published to the topic
 func (b *broker) Subscribe(topic string) (<-chan []byte, error) {
+	ch, err := b.SubscribeMessages(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan []byte, 100)
+	p := &payload{ch: ch, done: make(chan bool)}
+
+	b.mtx.Lock()
+	b.payloads[out] = p
+	b.mtx.Unlock()
+
+	go func() {
+		defer close(out)
+		defer func() {
+			b.mtx.Lock()
+			delete(b.payloads, out)
+			b.mtx.Unlock()
+		}()
+
+		// ends when unsubscribed or the broker closes
+		// even if the caller stopped receiving
+		for m := range ch {
+			select {
+			case out <- m.Payload:
+			case <-p.done:
+				return
+			case <-b.exit:
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// Unsubscribe unsubscribes a payload subscriber
+func (b *broker) Unsubscribe(topic string, sub <-chan []byte) error {
+	b.mtx.Lock()
+	p, ok := b.payloads[sub]
+	delete(b.payloads, sub)
+	b.mtx.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	close(p.done)
+
+	return b.UnsubscribeMessages(topic, p.ch)
+}
+
+func (b *broker) SubscribeMessages(topic string, opts ...SubscribeOption) (<-chan *Message, error) {
 	select {
 	case <-b.exit:
 		return nil, errors.New("broker closed")
 	default:
 	}
 
+	if err := validate(topic); err != nil {
+		return nil, err
+	}
+
+	options := new(SubscribeOptions)
+	for _, o := range opts {
+		o(options)
+	}
+
 	if b.options.Proxy {
-		return b.options.Client.Subscribe(topic)
+		return b.proxy(topic)
+	}
+
+	b.pmtx.RLock()
+	closing := b.closing
+	b.pmtx.RUnlock()
+
+	if closing {
+		return nil, errors.New("broker shutting down")
+	}
+
+	t, err := b.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	id := newId()
+	ch := make(chan *Message, 100)
+	sub := &subscriber{
+		id:        id,
+		metadata:  options.Metadata,
+		created:   time.Now(),
+		log:       b.options.Logger.With("topic", topic, "subscriber", id),
+		namespace: b.options.Namespace,
+		ch:        ch,
+		out:       ch,
+		exit:      make(chan bool),
+	}
+
+	var out chan *Message
+	if options.Offset > 0 {
+		out = make(chan *Message, 100)
+		sub.out = out
 	}
 
-	ch := make(chan []byte, 100)
 	b.Lock()
-	b.topics[topic] = append(b.topics[topic], ch)
+	t.subscribers = append(t.subscribers, sub)
+	t.observe()
 	b.Unlock()
-	return ch, nil
+
+	sub.log.Debug("Subscribed", "transport", options.Metadata["transport"], "remote", options.Metadata["remote"], "offset", options.Offset)
+
+	// replay from the offset once subscribed
+	// so no messages are missed in between
+	if out != nil {
+		go b.replay(t, sub, out, options.Offset)
+	}
+
+	return sub.out, nil
 }
 
-func (b *broker) Unsubscribe(topic string, sub <-chan []byte) error {
+func (b *broker) UnsubscribeMessages(topic string, sub <-chan *Message) error {
 	select {
 	case <-b.exit:
 		return errors.New("broker closed")
@@ -215,33 +920,42 @@ func (b *broker) Unsubscribe(topic string, sub <-chan []byte) error {
 	}
 
 	if b.options.Proxy {
-		return b.options.Client.Unsubscribe(sub)
+		b.mtx.Lock()
+		p, ok := b.proxied[sub]
+		delete(b.proxied, sub)
+		b.mtx.Unlock()
+		if !ok {
+			return nil
+		}
+		close(p.exit)
+		return b.options.Client.Unsubscribe(p.ch)
 	}
 
-	b.RLock()
-	subscribers, ok := b.topics[topic]
-	b.RUnlock()
+	b.Lock()
+	defer b.Unlock()
 
+	t, ok := b.topics[topic]
 	if !ok {
 		return nil
 	}
 
-	var subs []chan []byte
-	for _, subscriber := range subscribers {
-		if subscriber == sub {
+	var subs []*subscriber
+	for _, subscriber := range t.subscribers {
+		if subscriber.out == sub {
+			subscriber.close()
+			subscriber.log.Debug("Unsubscribed", "dropped", atomic.LoadInt64(&subscriber.dropped))
 			continue
 		}
 		subs = append(subs, subscriber)
 	}
 
-	b.Lock()
-	b.topics[topic] = subs
-	b.Unlock()
+	t.subscribers = subs
+	t.observe()
 	return nil
 }
 
-func Publish(topic string, payload []byte) error {
-	return Default.Publish(topic, payload)
+func Publish(topic string, payload []byte, opts ...PublishOption) error {
+	return Default.Publish(topic, payload, opts...)
 }
 
 func Subscribe(topic string) (<-chan []byte, error) {
@@ -252,6 +966,18 @@ func Unsubscribe(topic string, sub <-chan []byte) error {
 	return Default.Unsubscribe(topic, sub)
 }
 
+func SubscribeMessages(topic string, opts ...SubscribeOption) (<-chan *Message, error) {
+	return Default.SubscribeMessages(topic, opts...)
+}
+
+func UnsubscribeMessages(topic string, sub <-chan *Message) error {
+	return Default.UnsubscribeMessages(topic, sub)
+}
+
+func Fetch(topic string, opts ...FetchOption) ([]*Message, error) {
+	return Default.Fetch(topic, opts...)
+}
+
 func New(opts ...Option) *broker {
 	return newBroker(opts...)
 }
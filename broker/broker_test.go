@@ -1,9 +1,18 @@
 package broker
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/asim/emque/trace"
 )
 
 func TestBroker(t *testing.T) {
@@ -23,14 +32,14 @@ func TestBroker(t *testing.T) {
 		wg.Add(1)
 
 		go func() {
+			defer wg.Done()
 			e := <-ch
 			if string(e) != string(payload) {
-				t.Fatalf("%s expected %s got %s", topic, string(payload), string(e))
+				t.Errorf("%s expected %s got %s", topic, string(payload), string(e))
 			}
 			if err := b.Unsubscribe(topic, ch); err != nil {
-				t.Fatal(err)
+				t.Error(err)
 			}
-			wg.Done()
 		}()
 
 		if err := b.Publish(topic, payload); err != nil {
@@ -40,3 +49,576 @@ func TestBroker(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestSubscribeClose(t *testing.T) {
+	b := newBroker()
+
+	ch, err := b.Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fill the payload channel without receiving
+	for i := 0; len(ch) < cap(ch); i++ {
+		if i > 1000 {
+			t.Fatal("expected payload channel to fill")
+		}
+		if err := b.Publish("foo", []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// blocks the forwarding goroutine sending to the full channel
+	if err := b.Publish("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the forwarding goroutine ends with the broker
+	for i := 0; ; i++ {
+		if i > 100 {
+			t.Fatal("expected payload subscription to end")
+		}
+		b.mtx.RLock()
+		n := len(b.payloads)
+		b.mtx.RUnlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(Persist(true))
+
+	for i := 1; i <= 3; i++ {
+		if err := b.Publish("replay", []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ch, err := b.SubscribeMessages("replay", Offset(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("replay", []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(2); i <= 4; i++ {
+		select {
+		case m := <-ch:
+			if m.Id != i || string(m.Payload) != fmt.Sprintf("%d", i) {
+				t.Fatalf("expected message %d got %d %s", i, m.Id, string(m.Payload))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	b.Close()
+
+	// offsets are recovered from the log
+	b = New(Persist(true))
+	defer b.Close()
+
+	ch, err = b.SubscribeMessages("replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("replay", []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-ch:
+		if m.Id != 5 {
+			t.Fatalf("expected message 5 got %d", m.Id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message 5")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	b := New(Buffer(10))
+	defer b.Close()
+
+	// unknown topics are not created
+	msgs, err := b.Fetch("fetch")
+	if err != nil || len(msgs) > 0 {
+		t.Fatalf("expected no messages got %d %v", len(msgs), err)
+	}
+	if _, err := b.Describe("fetch"); err == nil {
+		t.Fatal("expected fetch not to create the topic")
+	}
+
+	// not buffered until the topic is fetched
+	if err := b.Publish("lazy", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := b.Describe("lazy"); err != nil || info.Buffered != 0 {
+		t.Fatalf("expected no buffered messages got %v %v", info, err)
+	}
+
+	// wait for the topic to be created
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		b.Publish("fetch", []byte("1"))
+	}()
+
+	msgs, err = b.Fetch("fetch", Group("w"), Wait(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Id != 1 {
+		t.Fatalf("expected message 1 got %d", len(msgs))
+	}
+
+	for i := 2; i <= 5; i++ {
+		if err := b.Publish("fetch", []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, err = b.Fetch("fetch", Group("a"), Max(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || msgs[0].Id != 1 || msgs[2].Id != 3 {
+		t.Fatalf("expected messages 1-3 got %d", len(msgs))
+	}
+
+	// group continues where it left off
+	msgs, err = b.Fetch("fetch", Group("a"), Max(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Id != 4 {
+		t.Fatalf("expected messages 4-5 got %d", len(msgs))
+	}
+
+	// other groups have their own position
+	msgs, err = b.Fetch("fetch", Group("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 5 {
+		t.Fatalf("expected 5 messages got %d", len(msgs))
+	}
+
+	// wait for new messages
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		b.Publish("fetch", []byte("6"))
+	}()
+
+	msgs, err = b.Fetch("fetch", Group("a"), Wait(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Id != 6 {
+		t.Fatalf("expected message 6 got %d", len(msgs))
+	}
+
+	// fetching from an id without committing leaves the group position
+	msgs, err = b.Fetch("fetch", Group("c"), From(4), Commit(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || msgs[0].Id != 4 {
+		t.Fatalf("expected messages 4-6 got %d", len(msgs))
+	}
+	if err := b.Commit("fetch", "c", 5); err != nil {
+		t.Fatal(err)
+	}
+	// offsets only move forward
+	if err := b.Commit("fetch", "c", 2); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err = b.Fetch("fetch", Group("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Id != 5 {
+		t.Fatalf("expected messages 5-6 got %d", len(msgs))
+	}
+
+	// waiting ends with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*50, cancel)
+
+	_, err = b.Fetch("fetch", Group("a"), Wait(time.Minute), FetchContext(ctx))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled got %v", err)
+	}
+}
+
+func TestFetchLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	interval := indexInterval
+	indexInterval = 10
+	defer func() { indexInterval = interval }()
+
+	b := New(Persist(true), Dir(dir), Buffer(5))
+	for i := 1; i <= 50; i++ {
+		if err := b.Publish("log", []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Close()
+
+	// reopened logs are indexed on recovery
+	b = New(Persist(true), Dir(dir), Buffer(5))
+	defer b.Close()
+
+	for i := 51; i <= 60; i++ {
+		if err := b.Publish("log", []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// read behind the buffer from indexed positions
+	for _, from := range []int64{1, 9, 10, 11, 25, 50, 54} {
+		msgs, err := b.Fetch("log", From(from), Max(3), Commit(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 3 {
+			t.Fatalf("from %d: expected 3 messages got %d", from, len(msgs))
+		}
+		for i, m := range msgs {
+			if want := from + int64(i); m.Id != want || string(m.Payload) != fmt.Sprintf("%d", want) {
+				t.Fatalf("from %d: expected message %d got %d %s", from, want, m.Id, m.Payload)
+			}
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ready := func(b *broker) {
+		for i := 0; b.Ready() != nil; i++ {
+			if i > 100 {
+				t.Fatalf("broker not ready: %v", b.Ready())
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	// nothing runs in the background without persistence
+	n := runtime.NumGoroutine()
+	b := newBroker()
+	ready(b)
+	for i := 0; runtime.NumGoroutine() > n; i++ {
+		if i > 100 {
+			t.Fatalf("expected %d goroutines got %d", n, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	b.Close()
+
+	// persisted messages are written without closing
+	b = newBroker(Persist(true), Dir(dir))
+	defer b.Close()
+	ready(b)
+	if err := b.Publish("foo", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "foo.mq"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 0 {
+			break
+		}
+		if i > 300 {
+			t.Fatal("timed out waiting for flush")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestInvalidTopic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := New(Persist(true), Dir(filepath.Join(dir, "a")))
+	defer b.Close()
+
+	for _, topic := range []string{"", "../b/foo", "foo/bar", `foo\bar`, ".."} {
+		if err := b.Publish(topic, []byte("foo")); !errors.Is(err, ErrInvalidTopic) {
+			t.Fatalf("publish %q: expected invalid topic got %v", topic, err)
+		}
+		if _, err := b.Subscribe(topic); !errors.Is(err, ErrInvalidTopic) {
+			t.Fatalf("subscribe %q: expected invalid topic got %v", topic, err)
+		}
+		if _, err := b.Fetch(topic); !errors.Is(err, ErrInvalidTopic) {
+			t.Fatalf("fetch %q: expected invalid topic got %v", topic, err)
+		}
+	}
+
+	// nothing is written outside the directory
+	if _, err := os.Stat(filepath.Join(dir, "b")); !os.IsNotExist(err) {
+		t.Fatalf("expected no directory b got %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := New(Persist(true), Dir(dir))
+	defer b.Close()
+
+	ch, err := b.SubscribeMessages("delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish("delete", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	<-ch
+
+	if err := b.Delete("delete"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("expected channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for channel to close")
+	}
+
+	if _, err := b.Describe("delete"); err == nil {
+		t.Fatal("expected deleted topic not to be found")
+	}
+	if err := b.Delete("delete"); err == nil {
+		t.Fatal("expected deleting a missing topic to fail")
+	}
+
+	// the topic starts again empty
+	msgs, err := b.Fetch("delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("expected no messages got %d", len(msgs))
+	}
+}
+
+func TestKick(t *testing.T) {
+	b := New()
+	defer b.Close()
+
+	ch, err := b.SubscribeMessages("kick", Metadata(map[string]string{"transport": "test"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := b.Describe("kick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Subscribers) != 1 || info.Subscribers[0].Metadata["transport"] != "test" {
+		t.Fatal("expected subscriber with metadata")
+	}
+
+	if err := b.Kick("kick", info.Subscribers[0].Id); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("expected channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for channel to close")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	mem := trace.NewMemory()
+	b := New(Tracer(trace.New(trace.WithExporter(mem))))
+	defer b.Close()
+
+	ch, err := b.SubscribeMessages("trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	if err := b.Publish("trace", []byte("foo"), Headers(map[string]string{
+		trace.TraceparentHeader: tp,
+		"foo":                   "bar",
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-ch
+	if m.Headers["foo"] != "bar" {
+		t.Fatalf("expected headers to be delivered got %v", m.Headers)
+	}
+
+	sc, ok := trace.Extract(m.Headers)
+	if !ok {
+		t.Fatal("expected trace context")
+	}
+	if sc.Traceparent() == tp {
+		t.Fatal("expected traceparent of the publish span")
+	}
+
+	// wait for the fan-out span
+	time.Sleep(time.Millisecond * 10)
+
+	spans := map[string]*trace.SpanData{}
+	for _, s := range mem.Spans() {
+		spans[s.Name] = s
+	}
+
+	publish, fanout := spans["publish"], spans["fanout"]
+	if publish == nil || fanout == nil {
+		t.Fatalf("expected publish and fanout spans got %v", spans)
+	}
+	if publish.ParentID != "00f067aa0ba902b7" || fanout.ParentID != publish.SpanID {
+		t.Fatalf("unexpected span parents publish %+v fanout %+v", publish, fanout)
+	}
+}
+
+func TestReady(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := New(Persist(true), Dir(dir))
+	if err := b.Publish("ready", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	if err := b.Ready(); err == nil {
+		t.Fatal("expected closed broker not to be ready")
+	}
+
+	// persisted topics are recovered on start
+	b = New(Persist(true), Dir(dir))
+	defer b.Close()
+
+	for i := 0; b.Ready() != nil; i++ {
+		if i > 100 {
+			t.Fatalf("broker not ready: %v", b.Ready())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	topics, err := b.Topics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 1 || topics[0].Name != "ready" || topics[0].Offset != 1 {
+		t.Fatalf("expected recovered topic got %+v", topics)
+	}
+
+	// the data directory must be writable
+	if err := os.Chmod(dir, 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0700)
+	if os.Getuid() != 0 && b.Ready() == nil {
+		t.Fatal("expected read only data directory not to be ready")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	b := New()
+
+	ch, err := b.SubscribeMessages("shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := b.Publish("shutdown", []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// slow subscriber drains its buffer before the channel is closed
+	received := make(chan int)
+	go func() {
+		var n int
+		for range ch {
+			n++
+			time.Sleep(time.Millisecond)
+		}
+		received <- n
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case n := <-received:
+		if n != 50 {
+			t.Fatalf("expected 50 messages got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber channel not closed")
+	}
+
+	if err := b.Publish("shutdown", []byte("foo")); err == nil {
+		t.Fatal("expected publish to fail after shutdown")
+	}
+}
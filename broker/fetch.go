@@ -0,0 +1,219 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// next returns the next offset for the group. New groups
+// start from the oldest message available.
+func (t *topic) next(group string) int64 {
+	if next, ok := t.groups[group]; ok {
+		return next
+	}
+	if t.store != nil {
+		return 1
+	}
+	if len(t.buffer) > 0 {
+		return t.buffer[0].Id
+	}
+	return t.offset + 1
+}
+
+// read returns up to max messages for the group from the id or its position
+// and commits its offset. If none are available a channel closed on publish
+// is returned.
+func (t *topic) read(group string, from int64, max int, commit bool) ([]*Message, <-chan bool, error) {
+	t.fetch.Lock()
+	defer t.fetch.Unlock()
+
+	t.Lock()
+	// buffer messages published from now on
+	t.fetched = true
+	// new groups start from the oldest message available now
+	if _, ok := t.groups[group]; !ok {
+		t.groups[group] = t.next(group)
+		t.dirty = true
+	}
+	next := from
+	if next <= 0 {
+		next = t.groups[group]
+	}
+
+	// nothing new
+	if next > t.offset {
+		if t.notify == nil {
+			t.notify = make(chan bool)
+		}
+		notify := t.notify
+		t.Unlock()
+		return nil, notify, nil
+	}
+
+	var msgs []*Message
+
+	if len(t.buffer) > 0 && next >= t.buffer[0].Id {
+		// read from memory
+		i := int(next - t.buffer[0].Id)
+		for ; i < len(t.buffer) && len(msgs) < max; i++ {
+			msgs = append(msgs, t.buffer[i])
+		}
+		t.Unlock()
+	} else if s := t.store; s != nil {
+		// read older messages from the log
+		t.Unlock()
+		err := s.Read(next, func(m *Message) bool {
+			msgs = append(msgs, m)
+			return len(msgs) < max
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if len(t.buffer) > 0 {
+		// messages were dropped from memory, skip to the oldest
+		for i := 0; i < len(t.buffer) && len(msgs) < max; i++ {
+			msgs = append(msgs, t.buffer[i])
+		}
+		t.Unlock()
+	} else {
+		t.Unlock()
+	}
+
+	if len(msgs) == 0 || !commit {
+		return msgs, nil, nil
+	}
+
+	// commit the group offset
+	t.Lock()
+	t.groups[group] = msgs[len(msgs)-1].Id + 1
+	t.dirty = true
+	t.Unlock()
+
+	return msgs, nil, nil
+}
+
+// read reads from the topic. Unknown topics are not created, the
+// channel returned is closed once a topic is created instead.
+func (b *broker) read(name string, options FetchOptions) ([]*Message, <-chan bool, error) {
+	b.RLock()
+	t, ok := b.topics[name]
+	b.RUnlock()
+	if ok {
+		return t.read(options.Group, options.From, options.Max, options.Commit)
+	}
+
+	// don't wait
+	if options.Wait <= 0 {
+		return nil, nil, nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.topics[name]; ok {
+		// created since, read again
+		created := make(chan bool)
+		close(created)
+		return nil, created, nil
+	}
+	if b.created == nil {
+		b.created = make(chan bool)
+	}
+	return nil, b.created, nil
+}
+
+func (b *broker) Fetch(topic string, opts ...FetchOption) ([]*Message, error) {
+	select {
+	case <-b.exit:
+		return nil, errors.New("broker closed")
+	default:
+	}
+
+	if b.options.Proxy {
+		return nil, errors.New("fetch not supported by proxy")
+	}
+
+	if err := validate(topic); err != nil {
+		return nil, err
+	}
+
+	options := FetchOptions{
+		Group:  "default",
+		Max:    100,
+		Commit: true,
+	}
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if options.Max <= 0 {
+		options.Max = 100
+	}
+
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var timeout <-chan time.Time
+	if options.Wait > 0 {
+		timer := time.NewTimer(options.Wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		msgs, notify, err := b.read(topic, options)
+		if err != nil || len(msgs) > 0 {
+			return msgs, err
+		}
+
+		// don't wait
+		if notify == nil || options.Wait <= 0 {
+			return nil, nil
+		}
+
+		select {
+		case <-notify:
+		case <-timeout:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-b.exit:
+			return nil, errors.New("broker closed")
+		}
+	}
+}
+
+// Commit sets the next offset fetched by the group. Offsets
+// only move forward so messages are not fetched twice.
+func (b *broker) Commit(topic, group string, offset int64) error {
+	select {
+	case <-b.exit:
+		return errors.New("broker closed")
+	default:
+	}
+
+	if b.options.Proxy {
+		return errors.New("commit not supported by proxy")
+	}
+
+	b.RLock()
+	t, ok := b.topics[topic]
+	b.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("topic %s not found", topic)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if offset > t.next(group) {
+		t.groups[group] = offset
+		t.dirty = true
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package broker
+
+import (
+	"github.com/asim/emque/metrics"
+)
+
+var (
+	published = metrics.NewCounter("emque_messages_published_total", "Messages published per topic.", "namespace", "topic")
+	delivered = metrics.NewCounter("emque_messages_delivered_total", "Messages delivered to subscribers per topic.", "namespace", "topic")
+	dropped   = metrics.NewCounter("emque_messages_dropped_total", "Messages dropped for slow subscribers per topic.", "namespace", "topic")
+	bytesIn   = metrics.NewCounter("emque_bytes_in_total", "Payload bytes published per topic.", "namespace", "topic")
+	bytesOut  = metrics.NewCounter("emque_bytes_out_total", "Payload bytes delivered to subscribers per topic.", "namespace", "topic")
+
+	active = metrics.NewGauge("emque_subscribers", "Active subscribers per topic.", "namespace", "topic")
+	depth  = metrics.NewGauge("emque_subscriber_buffer_depth", "Messages waiting in subscriber buffers per topic.", "namespace", "topic")
+
+	publishLatency = metrics.NewHistogram("emque_publish_duration_seconds", "Time to publish a message.", nil, "namespace", "topic")
+	writeLatency   = metrics.NewHistogram("emque_persist_write_duration_seconds", "Time to write persisted messages to disk.", nil, "namespace", "topic")
+	fsyncErrors    = metrics.NewCounter("emque_persist_fsync_errors_total", "Errors syncing persisted messages to disk.", "namespace", "topic")
+)
+
+// observe updates the topic gauges
+func (t *topic) observe() {
+	var n int
+	for _, sub := range t.subscribers {
+		n += len(sub.ch)
+	}
+	active.Set(float64(len(t.subscribers)), t.namespace, t.name)
+	depth.Set(float64(n), t.namespace, t.name)
+}
@@ -1,13 +1,28 @@
 package broker
 
 import (
+	"context"
+	"time"
+
 	"github.com/asim/emque/client"
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/trace"
 )
 
 type Options struct {
 	Client  client.Client
 	Proxy   bool
 	Persist bool
+	// Directory persisted topics are stored in
+	Dir string
+	// Number of recent messages kept in memory per topic for fetch
+	Buffer int
+	// Tracer records publish and fan-out spans
+	Tracer trace.Tracer
+	// Logger for subscriptions, drops and persistence errors
+	Logger logger.Logger
+	// Namespace the metrics are labelled with
+	Namespace string
 }
 
 type Option func(o *Options)
@@ -29,3 +44,159 @@ func Persist(b bool) Option {
 		o.Persist = b
 	}
 }
+
+// Dir sets the directory persisted topics are stored in.
+// Defaults to the working directory.
+func Dir(d string) Option {
+	return func(o *Options) {
+		o.Dir = d
+	}
+}
+
+// Buffer sets the number of recent messages kept in memory per topic
+func Buffer(i int) Option {
+	return func(o *Options) {
+		o.Buffer = i
+	}
+}
+
+// Tracer sets the tracer used to record spans
+func Tracer(t trace.Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = t
+	}
+}
+
+// Logger sets the logger
+func Logger(l logger.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// Namespace sets the namespace the metrics are labelled with
+func Namespace(ns string) Option {
+	return func(o *Options) {
+		o.Namespace = ns
+	}
+}
+
+type PublishOptions struct {
+	// Headers sent with the message e.g trace context
+	Headers map[string]string
+	// Context of the publish carrying the trace
+	Context context.Context
+	// Buffer for fetch even if the topic was never fetched
+	Buffered bool
+}
+
+type PublishOption func(o *PublishOptions)
+
+// Headers sets the message headers
+func Headers(h map[string]string) PublishOption {
+	return func(o *PublishOptions) {
+		o.Headers = h
+	}
+}
+
+// Context sets the context of the publish. Trace context
+// in the headers is used if the context carries none.
+func Context(ctx context.Context) PublishOption {
+	return func(o *PublishOptions) {
+		o.Context = ctx
+	}
+}
+
+// Buffered keeps the message for fetch even if the topic has not
+// been fetched yet e.g dead letters. The topic is buffered from then on.
+func Buffered(b bool) PublishOption {
+	return func(o *PublishOptions) {
+		o.Buffered = b
+	}
+}
+
+type SubscribeOptions struct {
+	// Replay persisted messages from this offset
+	Offset int64
+	// Metadata describing the subscriber e.g remote address
+	Metadata map[string]string
+}
+
+type SubscribeOption func(o *SubscribeOptions)
+
+// Offset replays persisted messages starting at the
+// message id before delivering new messages
+func Offset(id int64) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Offset = id
+	}
+}
+
+// Metadata sets metadata describing the subscriber
+func Metadata(md map[string]string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Metadata = md
+	}
+}
+
+type FetchOptions struct {
+	// Consumer group whose position is tracked
+	Group string
+	// Max number of messages returned
+	Max int
+	// Time to wait for messages if none are available
+	Wait time.Duration
+	// Id to fetch from rather than the group position
+	From int64
+	// Commit the group position. Defaults to true.
+	Commit bool
+	// Context cancelling the wait e.g the request
+	Context context.Context
+}
+
+type FetchOption func(o *FetchOptions)
+
+// Group sets the consumer group. Each fetch continues from the
+// position where the last fetch for the group left off.
+func Group(g string) FetchOption {
+	return func(o *FetchOptions) {
+		o.Group = g
+	}
+}
+
+// Max sets the max number of messages to fetch
+func Max(i int) FetchOption {
+	return func(o *FetchOptions) {
+		o.Max = i
+	}
+}
+
+// Wait sets how long to wait for messages if none are available
+func Wait(d time.Duration) FetchOption {
+	return func(o *FetchOptions) {
+		o.Wait = d
+	}
+}
+
+// From fetches from the message id rather than the group position
+func From(id int64) FetchOption {
+	return func(o *FetchOptions) {
+		o.From = id
+	}
+}
+
+// Commit sets whether the group position is committed on fetch.
+// Positions not committed on fetch are committed via Broker.Commit.
+func Commit(b bool) FetchOption {
+	return func(o *FetchOptions) {
+		o.Commit = b
+	}
+}
+
+// FetchContext sets the context of the fetch. Waiting for
+// messages ends when the context is done.
+func FetchContext(ctx context.Context) FetchOption {
+	return func(o *FetchOptions) {
+		o.Context = ctx
+	}
+}
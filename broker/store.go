@@ -0,0 +1,306 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// messages between entries in the log index
+var indexInterval int64 = 1000
+
+// internal persisted topic log
+type store struct {
+	sync.Mutex
+	file    *os.File
+	pending []byte
+	// written since the last sync
+	unsynced bool
+	// closed or removed
+	closed bool
+
+	// size and lines of the log including pending
+	size  int64
+	lines int64
+	// sparse index of message positions
+	index []position
+}
+
+// position of a message in the log
+type position struct {
+	id int64
+	// lines before the message
+	line int64
+	// byte offset of the message
+	offset int64
+}
+
+// newStore opens the log and returns the last message id
+func newStore(path string) (*store, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		return nil, 0, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0660)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s := &store{file: f}
+
+	// recover the last id. Logs written before ids
+	// were introduced are numbered by line.
+	var last, count int64
+	err = s.scan(position{}, func(m *Message, p position) bool {
+		count++
+		if m.Id > last {
+			last = m.Id
+		}
+		s.indexAt(p)
+		s.lines = p.line + 1
+		return true
+	})
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	s.size = fi.Size()
+
+	if count > last {
+		last = count
+	}
+
+	return s, last, nil
+}
+
+// scan reads messages in the log from the position
+func (s *store) scan(from position, fn func(*Message, position) bool) error {
+	f, err := os.Open(s.file.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(from.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	line := from.line
+	offset := from.offset
+	next := offset
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		next += int64(advance)
+		return advance, token, err
+	})
+
+	for scanner.Scan() {
+		p := position{line: line, offset: offset}
+		line++
+		offset = next
+
+		m := new(Message)
+		if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+			continue
+		}
+		if m.Id == 0 {
+			m.Id = line
+		}
+		p.id = m.Id
+		if !fn(m, p) {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+// indexAt adds the position to the index every indexInterval messages
+func (s *store) indexAt(p position) {
+	if n := len(s.index); n > 0 && p.id-s.index[n-1].id < indexInterval {
+		return
+	}
+	s.index = append(s.index, p)
+}
+
+// seek returns the indexed position at or before the id
+func (s *store) seek(id int64) position {
+	i := sort.Search(len(s.index), func(i int) bool {
+		return s.index[i].id > id
+	})
+	if i == 0 {
+		return position{}
+	}
+	return s.index[i-1]
+}
+
+// write buffers the message until the next flush
+func (s *store) write(m *Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.indexAt(position{id: m.Id, line: s.lines, offset: s.size})
+	s.pending = append(s.pending, b...)
+	s.pending = append(s.pending, '\n')
+	s.size += int64(len(b) + 1)
+	s.lines++
+	s.Unlock()
+	return nil
+}
+
+func (s *store) flush() error {
+	if s.closed || len(s.pending) == 0 {
+		return nil
+	}
+	_, err := s.file.Write(s.pending)
+	s.pending = nil
+	s.unsynced = true
+	return err
+}
+
+// Flush writes pending messages to the log
+func (s *store) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.flush()
+}
+
+// Sync commits written messages to stable storage
+func (s *store) Sync() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed || !s.unsynced {
+		return nil
+	}
+	s.unsynced = false
+	return s.file.Sync()
+}
+
+// Read calls fn for messages in the log from the offset
+func (s *store) Read(offset int64, fn func(*Message) bool) error {
+	s.Lock()
+	// flush so pending messages are read
+	err := s.flush()
+	from := s.seek(offset)
+	s.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return s.scan(from, func(m *Message, _ position) bool {
+		if m.Id < offset {
+			return true
+		}
+		return fn(m)
+	})
+}
+
+// Truncate deletes all messages in the log
+func (s *store) Truncate() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.pending = nil
+	s.size = 0
+	s.lines = 0
+	s.index = nil
+	return s.file.Truncate(0)
+}
+
+// Close flushes and closes the log
+func (s *store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.flush(); err != nil {
+		s.closed = true
+		s.file.Close()
+		return err
+	}
+	s.closed = true
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// Remove closes the log and deletes it with the group offsets
+func (s *store) Remove() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.pending = nil
+	s.closed = true
+	s.file.Close()
+
+	if err := os.Remove(s.offsetsPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(s.file.Name())
+}
+
+// offsetsPath returns the path of the group offsets file
+func (s *store) offsetsPath() string {
+	return strings.TrimSuffix(s.file.Name(), ".mq") + ".offsets"
+}
+
+// Offsets returns the persisted consumer group offsets
+func (s *store) Offsets() (map[string]int64, error) {
+	offsets := make(map[string]int64)
+
+	b, err := ioutil.ReadFile(s.offsetsPath())
+	if os.IsNotExist(err) {
+		return offsets, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &offsets); err != nil {
+		return nil, err
+	}
+
+	return offsets, nil
+}
+
+// SaveOffsets persists the consumer group offsets
+func (s *store) SaveOffsets(offsets map[string]int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	b, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+
+	// write and rename so the file is never partially written
+	path := s.offsetsPath()
+	if err := ioutil.WriteFile(path+".tmp", b, 0660); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -1,5 +1,10 @@
 package client
 
+import (
+	"context"
+	"time"
+)
+
 // Client is the interface provided by this package
 type Client interface {
 	Close() error
@@ -8,6 +13,28 @@ type Client interface {
 	Unsubscribe(<-chan []byte) error
 }
 
+// ContextClient is a Client publishing and subscribing with a context
+type ContextClient interface {
+	// PublishContext publishes within the deadline of the context
+	PublishContext(ctx context.Context, topic string, payload []byte) error
+	// SubscribeContext subscribes until the context is done
+	SubscribeContext(ctx context.Context, topic string) (<-chan []byte, error)
+}
+
+// BatchClient is a Client publishing messages in batches
+type BatchClient interface {
+	// PublishBatch publishes the messages in batches per server
+	// returning the error publishing each, nil if published
+	PublishBatch(ctx context.Context, msgs []*Message) []error
+}
+
+// HandlerClient is a Client calling handlers for messages
+type HandlerClient interface {
+	// Handle calls fn for messages published to the topic
+	// until the returned handler is stopped
+	Handle(topic string, fn HandlerFunc, opts ...HandleOption) (*Handler, error)
+}
+
 // Resolver resolves a name to a list of servers
 type Resolver interface {
 	Resolve(name string) ([]string, error)
@@ -26,6 +53,16 @@ var (
 	Servers = []string{"http://127.0.0.1:8081"}
 	// The default number of retries
 	Retries = 1
+	// Skip server verification by default since servers
+	// generate a self signed certificate if none is specified
+	InsecureSkipVerify = true
+	// The time to wait for a server to respond to a ping
+	PingTimeout = time.Second * 5
+	// Header selecting the namespace on the server
+	NamespaceHeader = "X-Emque-Namespace"
+	// The default backoff between attempts to resubscribe or handle a message
+	MinBackoff = time.Millisecond * 100
+	MaxBackoff = time.Second * 30
 )
 
 // Publish via the default Client
@@ -33,16 +70,124 @@ func Publish(topic string, payload []byte) error {
 	return Default.Publish(topic, payload)
 }
 
+// PublishContext via the default Client
+func PublishContext(ctx context.Context, topic string, payload []byte) error {
+	return publishContext(Default, ctx, topic, payload)
+}
+
+// PublishBatch via the default Client
+func PublishBatch(ctx context.Context, msgs []*Message) []error {
+	return publishBatch(Default, ctx, msgs)
+}
+
 // Subscribe via the default Client
 func Subscribe(topic string) (<-chan []byte, error) {
 	return Default.Subscribe(topic)
 }
 
+// SubscribeContext via the default Client
+func SubscribeContext(ctx context.Context, topic string) (<-chan []byte, error) {
+	return subscribeContext(Default, ctx, topic)
+}
+
 // Unsubscribe via the default Client
 func Unsubscribe(ch <-chan []byte) error {
 	return Default.Unsubscribe(ch)
 }
 
+// Handle via the default Client
+func Handle(topic string, fn HandlerFunc, opts ...HandleOption) (*Handler, error) {
+	return handle(Default, topic, fn, opts...)
+}
+
+// publishContext publishes with the client if it supports contexts
+// otherwise publishing unless the context is already done
+func publishContext(c Client, ctx context.Context, topic string, payload []byte) error {
+	if cc, ok := c.(ContextClient); ok {
+		return cc.PublishContext(ctx, topic, payload)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Publish(topic, payload)
+}
+
+// publishBatch publishes the batch with the client if it supports
+// batches otherwise publishing each message in turn
+func publishBatch(c Client, ctx context.Context, msgs []*Message) []error {
+	if bc, ok := c.(BatchClient); ok {
+		return bc.PublishBatch(ctx, msgs)
+	}
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		errs[i] = publishContext(c, ctx, m.Topic, m.Payload)
+	}
+	return errs
+}
+
+// subscribeContext subscribes with the client if it supports contexts
+// otherwise unsubscribing once the context is done
+func subscribeContext(c Client, ctx context.Context, topic string) (<-chan []byte, error) {
+	if cc, ok := c.(ContextClient); ok {
+		return cc.SubscribeContext(ctx, topic)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ch, err := c.Subscribe(topic)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			c.Unsubscribe(ch)
+		}()
+	}
+	return ch, nil
+}
+
+// handle calls fn with the client if it supports handlers otherwise
+// serving a subscription with messages delivered again on failure
+func handle(c Client, topic string, fn HandlerFunc, opts ...HandleOption) (*Handler, error) {
+	if hc, ok := c.(HandlerClient); ok {
+		return hc.Handle(topic, fn, opts...)
+	}
+
+	ch, err := c.Subscribe(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	h := NewHandler(fn, opts...)
+	deliveries := make(chan *Delivery)
+
+	go func() {
+		for {
+			select {
+			case b, ok := <-ch:
+				if !ok {
+					return
+				}
+				m := &Message{Topic: topic, Payload: b, Attempt: 1}
+				select {
+				case deliveries <- redeliver(deliveries, m, h.exit):
+				case <-h.exit:
+					return
+				}
+			case <-h.exit:
+				return
+			}
+		}
+	}()
+
+	h.Serve(deliveries, func() {
+		c.Unsubscribe(ch)
+	})
+
+	return h, nil
+}
+
 // New returns a new Client
 func New(opts ...Option) Client {
 	return newHTTPClient(opts...)
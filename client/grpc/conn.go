@@ -0,0 +1,45 @@
+package client
+
+import (
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// conn returns the connection to the server, dialing one if none is open.
+// Connections are shared by publishes, subscriptions and pings, reconnect
+// with backoff when the server is unreachable and are closed by Close.
+func (c *grpcClient) conn(addr string) (*grpc.ClientConn, error) {
+	c.cmtx.Lock()
+	defer c.cmtx.Unlock()
+
+	select {
+	case <-c.exit:
+		return nil, errors.New("client closed")
+	default:
+	}
+
+	if cc, ok := c.conns[addr]; ok && cc.GetState() != connectivity.Shutdown {
+		return cc, nil
+	}
+
+	cc, err := grpc.Dial(addr, c.dialOptions(addr)...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.conns[addr] = cc
+	return cc, nil
+}
+
+// closeConns closes the connection to every server
+func (c *grpcClient) closeConns() {
+	c.cmtx.Lock()
+	defer c.cmtx.Unlock()
+
+	for addr, cc := range c.conns {
+		cc.Close()
+		delete(c.conns, addr)
+	}
+}
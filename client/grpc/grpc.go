@@ -1,103 +1,277 @@
 package client
 
 import (
-	"crypto/tls"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/asim/emque/client"
 	"github.com/asim/emque/client/selector"
+	"github.com/asim/emque/logger"
 	pb "github.com/asim/emque/proto"
+	"github.com/asim/emque/trace"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 // internal grpcClient
 type grpcClient struct {
 	exit    chan bool
 	options client.Options
+	err     error
+	creds   credentials.TransportCredentials
 
 	sync.RWMutex
 	subscribers map[<-chan []byte]*subscriber
+	handlers    map[*client.Handler]bool
+
+	// connections per server
+	cmtx  sync.Mutex
+	conns map[string]*grpc.ClientConn
+
+	// publish streams per server
+	pmtx       sync.Mutex
+	publishers map[string]*publisher
+	// servers which do not support streaming
+	unary map[string]bool
 }
 
 // internal subscriber
 type subscriber struct {
 	wg    sync.WaitGroup
+	ctx   context.Context
 	ch    chan<- []byte
 	exit  chan bool
 	topic string
 }
 
-func grpcPublish(addr, topic string, payload []byte) error {
-	var dialOpts []grpc.DialOption
+// dialOptions returns the dial options for the address
+func (c *grpcClient) dialOptions(addr string) []grpc.DialOption {
+	// unix domain sockets are always plaintext
+	if c.options.Insecure || strings.HasPrefix(addr, "unix://") {
+		return []grpc.DialOption{grpc.WithInsecure()}
+	}
+	return []grpc.DialOption{grpc.WithTransportCredentials(c.creds)}
+}
 
-	creds := credentials.NewTLS(&tls.Config{
-		InsecureSkipVerify: true,
-	})
+// context returns the context selecting the namespace
+func (c *grpcClient) context(ctx context.Context) context.Context {
+	if len(c.options.Namespace) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, strings.ToLower(client.NamespaceHeader), c.options.Namespace)
+}
 
-	dialOpts = append(dialOpts, grpc.WithTransportCredentials(creds))
+func (c *grpcClient) grpcPublish(ctx context.Context, addr, topic string, payload []byte) error {
+	ctx, span := c.options.Tracer.Start(ctx, "publish")
+	defer span.End()
+	span.SetAttribute("topic", topic)
 
-	conn, err := grpc.Dial(addr, dialOpts...)
+	hdr := make(map[string]string)
+	trace.Inject(span.Context(), hdr)
+
+	req := &pb.PubRequest{
+		Topic:   topic,
+		Payload: payload,
+		Headers: hdr,
+	}
+
+	// publish over the stream if supported
+	if ok, err := c.streamPublish(ctx, addr, req); ok {
+		span.SetError(err)
+		return err
+	}
+
+	conn, err := c.conn(addr)
 	if err != nil {
+		span.SetError(err)
 		return err
 	}
-	defer conn.Close()
 
-	c := pb.NewMQClient(conn)
-	_, err = c.Pub(context.TODO(), &pb.PubRequest{
-		Topic:   topic,
-		Payload: payload,
-	})
+	cc := pb.NewMQClient(conn)
+	_, err = cc.Pub(c.context(ctx), req)
+	span.SetError(err)
 
 	return err
 }
 
-func grpcSubscribe(addr string, s *subscriber) error {
-	var dialOpts []grpc.DialOption
+// grpcPublishBatch publishes the messages with PubBatch falling back
+// to publishing each message if the server does not support it
+func (c *grpcClient) grpcPublishBatch(ctx context.Context, addr string, msgs []*client.Message) ([]error, error) {
+	ctx, span := c.options.Tracer.Start(ctx, "publish")
+	defer span.End()
+	span.SetAttribute("messages", strconv.Itoa(len(msgs)))
 
-	creds := credentials.NewTLS(&tls.Config{
-		InsecureSkipVerify: true,
-	})
+	req := &pb.PubBatchRequest{
+		Messages: make([]*pb.PubRequest, len(msgs)),
+	}
+
+	for i, m := range msgs {
+		hdr := make(map[string]string, len(m.Headers)+2)
+		for k, v := range m.Headers {
+			hdr[k] = v
+		}
+		if _, ok := hdr[trace.TraceparentHeader]; !ok {
+			trace.Inject(span.Context(), hdr)
+		}
+		req.Messages[i] = &pb.PubRequest{
+			Topic:   m.Topic,
+			Payload: m.Payload,
+			Headers: hdr,
+		}
+	}
+
+	conn, err := c.conn(addr)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	rsp, err := pb.NewMQClient(conn).PubBatch(c.context(ctx), req)
+
+	// older servers do not support batches
+	if status.Code(err) == codes.Unimplemented {
+		errs := make([]error, len(msgs))
+		for i, m := range msgs {
+			errs[i] = c.grpcPublish(ctx, addr, m.Topic, m.Payload)
+		}
+		return errs, nil
+	}
 
-	dialOpts = append(dialOpts, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+
+	if len(rsp.Errors) != len(msgs) {
+		return nil, fmt.Errorf("expected %d results got %d", len(msgs), len(rsp.Errors))
+	}
+
+	errs := make([]error, len(msgs))
+	for i, e := range rsp.Errors {
+		if len(e) > 0 {
+			errs[i] = errors.New(e)
+		}
+	}
+	return errs, nil
+}
 
-	conn, err := grpc.Dial(addr, dialOpts...)
+func (c *grpcClient) grpcPing(addr string) error {
+	conn, err := c.conn(addr)
 	if err != nil {
 		return err
 	}
 
-	c := pb.NewMQClient(conn)
-	sub, err := c.Sub(context.TODO(), &pb.SubRequest{
-		Topic: s.topic,
-	})
+	ctx, cancel := context.WithTimeout(context.Background(), client.PingTimeout)
+	defer cancel()
+
+	rsp, err := healthpb.NewHealthClient(conn).Check(ctx, new(healthpb.HealthCheckRequest))
 	if err != nil {
 		return err
 	}
+	if rsp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("status %s", rsp.Status)
+	}
+	return nil
+}
+
+// sub opens a subscription stream to the server replaying
+// persisted messages from the offset if greater than zero
+func (c *grpcClient) sub(addr string, s *subscriber, offset int64) (pb.MQ_SubClient, context.CancelFunc, error) {
+	conn, err := c.conn(addr)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	ctx, cancel := context.WithCancel(c.context(s.ctx))
+
+	cc := pb.NewMQClient(conn)
+	sub, err := cc.Sub(ctx, &pb.SubRequest{
+		Topic:  s.topic,
+		Offset: offset,
+	})
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	// end the stream on unsubscribe
 	go func() {
 		select {
 		case <-s.exit:
-			conn.Close()
+		case <-ctx.Done():
 		}
+		cancel()
 	}()
 
+	return sub, cancel, nil
+}
+
+// recv sends messages received on the stream to the subscriber until
+// the stream fails or the subscriber exits, recording the last id
+func (c *grpcClient) recv(sub pb.MQ_SubClient, s *subscriber, last *int64) error {
+	for {
+		rsp, err := sub.Recv()
+		if err != nil {
+			return err
+		}
+
+		c.receive(s.topic, rsp.Headers)
+		*last = rsp.Id
+
+		select {
+		case s.ch <- rsp.Payload:
+		case <-s.exit:
+			return nil
+		}
+	}
+}
+
+// grpcSubscribe subscribes to the server resubscribing after
+// the last message received if the stream fails
+func (c *grpcClient) grpcSubscribe(addr string, s *subscriber) error {
+	sub, cancel, err := c.sub(addr, s, 0)
+	if err != nil {
+		return err
+	}
+
+	s.wg.Add(1)
+
 	go func() {
 		defer s.wg.Done()
 
+		// id of the last message received
+		var last int64
+
 		for {
-			rsp, err := sub.Recv()
-			if err != nil {
-				conn.Close()
-				return
-			}
+			err := c.recv(sub, s, &last)
+			cancel()
 
 			select {
-			case s.ch <- rsp.Payload:
 			case <-s.exit:
 				return
+			default:
+			}
+
+			ok := client.Resubscribe(c.options, s.topic, addr, err, s.exit, func() error {
+				var offset int64
+				if last > 0 {
+					offset = last + 1
+				}
+				var err error
+				sub, cancel, err = c.sub(addr, s, offset)
+				return err
+			})
+			if !ok {
+				return
 			}
 		}
 	}()
@@ -105,6 +279,14 @@ func grpcSubscribe(addr string, s *subscriber) error {
 	return nil
 }
 
+// receive records the receipt of a message
+func (c *grpcClient) receive(topic string, headers map[string]string) {
+	ctx := trace.ExtractContext(context.Background(), headers)
+	_, span := c.options.Tracer.Start(ctx, "receive")
+	span.SetAttribute("topic", topic)
+	span.End()
+}
+
 func (c *grpcClient) run() {
 	// is there a resolver?
 	if c.options.Resolver == nil {
@@ -144,22 +326,52 @@ func (c *grpcClient) Close() error {
 		return nil
 	default:
 		close(c.exit)
+
+		// wait for handlers in flight to be acknowledged
+		c.RLock()
+		var handlers []*client.Handler
+		for h := range c.handlers {
+			handlers = append(handlers, h)
+		}
+		c.RUnlock()
+
+		for _, h := range handlers {
+			h.Stop(context.Background())
+		}
+
 		c.Lock()
 		for _, sub := range c.subscribers {
 			sub.Close()
 		}
 		c.Unlock()
+
+		c.pmtx.Lock()
+		for _, p := range c.publishers {
+			p.close(errors.New("client closed"))
+		}
+		c.publishers = make(map[string]*publisher)
+		c.pmtx.Unlock()
+
+		c.closeConns()
 	}
 	return nil
 }
 
 func (c *grpcClient) Publish(topic string, payload []byte) error {
+	return c.PublishContext(context.Background(), topic, payload)
+}
+
+func (c *grpcClient) PublishContext(ctx context.Context, topic string, payload []byte) error {
 	select {
 	case <-c.exit:
 		return errors.New("client closed")
 	default:
 	}
 
+	if c.err != nil {
+		return c.err
+	}
+
 	servers, err := c.options.Selector.Get(topic)
 	if err != nil {
 		return err
@@ -168,23 +380,71 @@ func (c *grpcClient) Publish(topic string, payload []byte) error {
 	var grr error
 	for _, addr := range servers {
 		for i := 0; i < 1+c.options.Retries; i++ {
-			err := grpcPublish(addr, topic, payload)
+			// don't retry once the context is done
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err := c.grpcPublish(ctx, addr, topic, payload)
 			if err == nil {
 				break
 			}
+			c.options.Logger.Warn("Publish failed", "server", addr, "topic", topic, "attempt", i+1, "error", err)
 			grr = err
 		}
 	}
 	return grr
 }
 
+func (c *grpcClient) PublishBatch(ctx context.Context, msgs []*client.Message) []error {
+	errs := make([]error, len(msgs))
+
+	var err error
+	select {
+	case <-c.exit:
+		err = errors.New("client closed")
+	default:
+		err = c.err
+	}
+
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	return client.Batch(ctx, c.options, msgs, c.grpcPublishBatch)
+}
+
+// Ping checks all servers are reachable
+func (c *grpcClient) Ping() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	for _, addr := range c.options.Servers {
+		if err := c.grpcPing(addr); err != nil {
+			return fmt.Errorf("server %s unreachable: %v", addr, err)
+		}
+	}
+	return nil
+}
+
 func (c *grpcClient) Subscribe(topic string) (<-chan []byte, error) {
+	return c.SubscribeContext(context.Background(), topic)
+}
+
+func (c *grpcClient) SubscribeContext(ctx context.Context, topic string) (<-chan []byte, error) {
 	select {
 	case <-c.exit:
 		return nil, errors.New("client closed")
 	default:
 	}
 
+	if c.err != nil {
+		return nil, c.err
+	}
+
 	servers, err := c.options.Selector.Get(topic)
 	if err != nil {
 		return nil, err
@@ -193,6 +453,7 @@ func (c *grpcClient) Subscribe(topic string) (<-chan []byte, error) {
 	ch := make(chan []byte, len(c.options.Servers)*256)
 
 	s := &subscriber{
+		ctx:   ctx,
 		ch:    ch,
 		exit:  make(chan bool),
 		topic: topic,
@@ -201,15 +462,34 @@ func (c *grpcClient) Subscribe(topic string) (<-chan []byte, error) {
 	var grr error
 	for _, addr := range servers {
 		for i := 0; i < 1+c.options.Retries; i++ {
-			err := grpcSubscribe(addr, s)
+			if err := ctx.Err(); err != nil {
+				s.Close()
+				return nil, err
+			}
+			err := c.grpcSubscribe(addr, s)
 			if err == nil {
-				s.wg.Add(1)
 				break
 			}
+			c.options.Logger.Warn("Subscribe failed", "server", addr, "topic", topic, "attempt", i+1, "error", err)
 			grr = err
 		}
 	}
 
+	c.Lock()
+	c.subscribers[ch] = s
+	c.Unlock()
+
+	// unsubscribe when the context is done
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.Unsubscribe(ch)
+			case <-s.exit:
+			}
+		}()
+	}
+
 	return ch, grr
 }
 
@@ -221,8 +501,11 @@ func (c *grpcClient) Unsubscribe(ch <-chan []byte) error {
 	}
 
 	c.Lock()
-	defer c.Unlock()
-	if sub, ok := c.subscribers[ch]; ok {
+	sub, ok := c.subscribers[ch]
+	delete(c.subscribers, ch)
+	c.Unlock()
+
+	if ok {
 		return sub.Close()
 	}
 	return nil
@@ -241,22 +524,43 @@ func (s *subscriber) Close() error {
 // New returns a grpc Client
 func New(opts ...client.Option) *grpcClient {
 	options := client.Options{
-		Selector: new(selector.All),
-		Servers:  client.Servers,
-		Retries:  client.Retries,
+		Selector:           new(selector.All),
+		Servers:            client.Servers,
+		Retries:            client.Retries,
+		InsecureSkipVerify: client.InsecureSkipVerify,
+		Resubscribe:        true,
+		MinBackoff:         client.MinBackoff,
+		MaxBackoff:         client.MaxBackoff,
 	}
 
 	for _, o := range opts {
 		o(&options)
 	}
 
+	if options.Tracer == nil {
+		options.Tracer = trace.Default
+	}
+
+	if options.Logger == nil {
+		options.Logger = logger.Default
+	}
+
 	// set servers
 	options.Selector.Set(options.Servers...)
 
+	// errors are returned on publish and subscribe
+	config, err := client.TLSConfig(options)
+
 	c := &grpcClient{
 		exit:        make(chan bool),
 		options:     options,
+		err:         err,
+		creds:       credentials.NewTLS(config),
 		subscribers: make(map[<-chan []byte]*subscriber),
+		handlers:    make(map[*client.Handler]bool),
+		conns:       make(map[string]*grpc.ClientConn),
+		publishers:  make(map[string]*publisher),
+		unary:       make(map[string]bool),
 	}
 	go c.run()
 	return c
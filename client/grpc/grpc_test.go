@@ -0,0 +1,603 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asim/emque/broker"
+	mqclient "github.com/asim/emque/client"
+	"github.com/asim/emque/server"
+	grpcsrv "github.com/asim/emque/server/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// testServer returns the address of a unix socket in a temporary directory,
+// a function serving the broker on it and one removing the directory
+func testServer(t *testing.T) (string, func(broker.Broker) server.Server, func()) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := "unix://" + filepath.Join(dir, "mq.sock")
+
+	serve := func(b broker.Broker) server.Server {
+		srv := grpcsrv.New(
+			server.WithAddress(addr),
+			server.WithInsecure(true),
+			server.WithBroker(b),
+		)
+		go srv.Run()
+		return srv
+	}
+
+	return addr, serve, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	addr, serve, cleanup := testServer(t)
+	defer cleanup()
+
+	b := broker.New()
+	srv := serve(b)
+	defer srv.Stop()
+
+	c := New(mqclient.WithServers(addr), mqclient.WithRetries(0))
+	defer c.Close()
+
+	ch, err := b.Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the server to listen
+	for i := 0; c.Ping() != nil; i++ {
+		if i > 100 {
+			t.Fatal("server not reachable")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// messages are published concurrently over one stream
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := c.Publish("foo", []byte(fmt.Sprintf("%d", i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	c.pmtx.Lock()
+	n := len(c.publishers)
+	c.pmtx.Unlock()
+	if n != 1 {
+		t.Fatalf("expected 1 publish stream got %d", n)
+	}
+
+	// errors publishing are returned in the ack
+	b.Close()
+	if err := c.Publish("foo", []byte("foo")); err == nil {
+		t.Fatal("expected publish to a closed broker to fail")
+	}
+}
+
+func TestConn(t *testing.T) {
+	addr, serve, cleanup := testServer(t)
+	defer cleanup()
+
+	a := broker.New()
+	defer a.Close()
+	srv := serve(a)
+
+	c := New(mqclient.WithServers(addr), mqclient.WithRetries(0))
+
+	for i := 0; c.Ping() != nil; i++ {
+		if i > 100 {
+			t.Fatal("server not reachable")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ch, err := c.Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for the server to subscribe
+	for i := 0; ; i++ {
+		if info, err := a.Describe("foo"); err == nil && len(info.Subscribers) > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("subscriber not found")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err := c.Publish("foo", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	// pings, publishes and subscriptions share one connection
+	c.cmtx.Lock()
+	n := len(c.conns)
+	conn := c.conns[addr]
+	c.cmtx.Unlock()
+	if n != 1 {
+		t.Fatalf("expected 1 connection got %d", n)
+	}
+
+	if err := c.Unsubscribe(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection reconnects to a restarted server
+	srv.Stop()
+	b := broker.New()
+	defer b.Close()
+	srv = serve(b)
+	defer srv.Stop()
+
+	sub, err := b.Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; c.Publish("foo", []byte("b")) != nil; i++ {
+		if i > 100 {
+			t.Fatal("failed to publish after restart")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	select {
+	case <-sub:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	c.cmtx.Lock()
+	reused := c.conns[addr] == conn
+	c.cmtx.Unlock()
+	if !reused {
+		t.Fatal("expected the connection to be reused")
+	}
+
+	c.Close()
+	if conn.GetState() != connectivity.Shutdown {
+		t.Fatalf("expected connection to be closed got %v", conn.GetState())
+	}
+}
+
+func TestResubscribe(t *testing.T) {
+	addr, serve, cleanup := testServer(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	publish := func(b broker.Broker, payload string) {
+		// wait for persisted topics to be recovered
+		for i := 0; b.Publish("foo", []byte(payload)) != nil; i++ {
+			if i > 100 {
+				t.Fatal("failed to publish")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	a := broker.New(broker.Persist(true), broker.Dir(dir))
+	srv := serve(a)
+
+	events := make(chan mqclient.Event, 100)
+
+	c := New(
+		mqclient.WithServers(addr),
+		mqclient.WithRetries(0),
+		mqclient.WithBackoff(time.Millisecond*10, time.Millisecond*100),
+		mqclient.WithStateChange(func(e mqclient.Event) {
+			events <- e
+		}),
+	)
+	defer c.Close()
+
+	for i := 0; c.Ping() != nil; i++ {
+		if i > 100 {
+			t.Fatal("server not reachable")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ch, err := c.Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if info, err := a.Describe("foo"); err == nil && len(info.Subscribers) > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("subscriber not found")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	publish(a, "1")
+
+	recv := func(want string) {
+		select {
+		case p := <-ch:
+			if string(p) != want {
+				t.Fatalf("expected %s got %s", want, string(p))
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+	recv("1")
+
+	// closing the broker ends the subscription
+	a.Close()
+	srv.Stop()
+
+	// messages published while disconnected are replayed
+	b := broker.New(broker.Persist(true), broker.Dir(dir))
+	publish(b, "2")
+
+	srv = serve(b)
+	defer srv.Stop()
+	// ends the subscription before the server stops
+	defer b.Close()
+
+	recv("2")
+	publish(b, "3")
+	recv("3")
+
+	var states []mqclient.State
+	for len(events) > 0 {
+		e := <-events
+		if e.Topic != "foo" || e.Server != addr {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		states = append(states, e.State)
+	}
+	if len(states) < 3 || states[0] != mqclient.Disconnected || states[len(states)-1] != mqclient.Connected {
+		t.Fatalf("expected disconnected then connected got %v", states)
+	}
+}
+
+func TestContext(t *testing.T) {
+	addr, serve, cleanup := testServer(t)
+	defer cleanup()
+
+	b := broker.New()
+	defer b.Close()
+
+	srv := serve(b)
+	defer srv.Stop()
+
+	c := New(mqclient.WithServers(addr), mqclient.WithRetries(0))
+	defer c.Close()
+
+	for i := 0; c.Ping() != nil; i++ {
+		if i > 100 {
+			t.Fatal("server not reachable")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// publishes are not attempted once cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.PublishContext(ctx, "foo", []byte("foo")); err != context.Canceled {
+		t.Fatalf("expected context canceled got %v", err)
+	}
+
+	subscribers := func() int {
+		info, err := b.Describe("foo")
+		if err != nil {
+			return 0
+		}
+		return len(info.Subscribers)
+	}
+
+	// cancelling the context ends the subscription
+	ctx, cancel = context.WithCancel(context.Background())
+	if _, err := c.SubscribeContext(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; subscribers() != 1; i++ {
+		if i > 100 {
+			t.Fatal("subscriber not found")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	cancel()
+	for i := 0; subscribers() != 0; i++ {
+		if i > 100 {
+			t.Fatal("expected subscription to end")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	c.RLock()
+	n := len(c.subscribers)
+	c.RUnlock()
+	if n != 0 {
+		t.Fatalf("expected no subscribers got %d", n)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	addr, serve, cleanup := testServer(t)
+	defer cleanup()
+
+	b := broker.New()
+	srv := serve(b)
+	defer srv.Stop()
+	defer b.Close()
+
+	// no handler is returned if every server fails
+	uc := New(mqclient.WithServers("127.0.0.1:1"), mqclient.WithRetries(0), mqclient.WithResubscribe(false))
+	if h, err := uc.Handle("foo", func(ctx context.Context, m *mqclient.Message) error {
+		return nil
+	}); h != nil || err == nil {
+		t.Fatalf("expected no handler and an error got %v %v", h, err)
+	}
+	uc.Close()
+
+	c := New(mqclient.WithServers(addr), mqclient.WithRetries(0))
+	defer c.Close()
+
+	for i := 0; c.Ping() != nil; i++ {
+		if i > 100 {
+			t.Fatal("server not reachable")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	var mtx sync.Mutex
+	var running, max int
+	attempts := make(map[string]int)
+	handled := make(chan string, 10)
+	release := make(chan bool)
+
+	// not buffered until the consumer fetches the topic
+	if err := b.Publish("foo", []byte("ready")); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := c.Handle("foo", func(ctx context.Context, m *mqclient.Message) error {
+		p := string(m.Payload)
+
+		mtx.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		attempts[p] = m.Attempt
+		mtx.Unlock()
+
+		defer func() {
+			mtx.Lock()
+			running--
+			mtx.Unlock()
+		}()
+
+		switch {
+		case p == "fail" && m.Attempt == 1:
+			return fmt.Errorf("failed")
+		case p == "panic" && m.Attempt == 1:
+			panic("handler panic")
+		case p == "block":
+			<-release
+		default:
+			time.Sleep(time.Millisecond * 20)
+		}
+
+		handled <- p
+		return nil
+	}, mqclient.Concurrency(3), mqclient.HandleBackoff(time.Millisecond*10, time.Millisecond*50))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the consumer group to fetch the topic
+	for i := 0; ; i++ {
+		if info, err := b.Describe("foo"); err == nil && len(info.Groups) > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("topic not fetched")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	for _, p := range []string{"0", "1", "2", "3", "fail", "panic"} {
+		if err := b.Publish("foo", []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	mtx.Lock()
+	if max > 3 {
+		t.Fatalf("expected at most 3 concurrent handlers got %d", max)
+	}
+	// failed and panicking messages are delivered again
+	for _, p := range []string{"fail", "panic"} {
+		if attempts[p] != 2 {
+			t.Fatalf("expected %s to be handled on attempt 2 got %d", p, attempts[p])
+		}
+	}
+	mtx.Unlock()
+
+	// stop waits for handlers in flight
+	if err := b.Publish("foo", []byte("block")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		mtx.Lock()
+		n := running
+		mtx.Unlock()
+		if n == 1 {
+			break
+		}
+		if i > 500 {
+			t.Fatal("expected handler to run")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		stopped <- h.Stop(ctx)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("stopped with a handler in flight")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	close(release)
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for stop")
+	}
+
+	c.RLock()
+	n := len(c.handlers)
+	c.RUnlock()
+	if n != 0 {
+		t.Fatalf("expected no handlers got %d", n)
+	}
+}
+
+func TestProducer(t *testing.T) {
+	addr, serve, cleanup := testServer(t)
+	defer cleanup()
+
+	b := broker.New()
+	srv := serve(b)
+	defer srv.Stop()
+
+	c := New(mqclient.WithServers(addr), mqclient.WithRetries(0))
+	defer c.Close()
+
+	ch, err := b.Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; c.Ping() != nil; i++ {
+		if i > 100 {
+			t.Fatal("server not reachable")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	var mtx sync.Mutex
+	var called int
+
+	// batches are sent when full and the rest on close
+	p := mqclient.NewProducer(c,
+		mqclient.BatchSize(10),
+		mqclient.FlushInterval(time.Minute),
+		mqclient.Callback(func(m *mqclient.Message, err error) {
+			mtx.Lock()
+			called++
+			mtx.Unlock()
+		}),
+	)
+
+	var futures []*mqclient.Future
+	for i := 0; i < 25; i++ {
+		futures = append(futures, p.Publish("foo", []byte(fmt.Sprintf("%d", i))))
+	}
+
+	for i := 0; i < 20; i++ {
+		select {
+		case <-ch:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	if err := futures[19].Wait(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-futures[20].Done():
+		t.Fatal("expected message of partial batch to be pending")
+	default:
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 20; i < 25; i++ {
+		select {
+		case <-ch:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	for i, f := range futures {
+		if err := f.Wait(); err != nil {
+			t.Fatalf("message %d failed: %v", i, err)
+		}
+	}
+
+	mtx.Lock()
+	if called != 25 {
+		t.Fatalf("expected 25 callbacks got %d", called)
+	}
+	mtx.Unlock()
+
+	if err := p.Publish("foo", []byte("closed")).Wait(); err == nil {
+		t.Fatal("expected publish to fail once closed")
+	}
+}
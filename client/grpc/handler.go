@@ -0,0 +1,260 @@
+package client
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/asim/emque/client"
+	pb "github.com/asim/emque/proto"
+	"golang.org/x/net/context"
+)
+
+// internal consumer delivering messages of a Consume stream to a handler
+type consumer struct {
+	wg         sync.WaitGroup
+	exit       chan bool
+	topic      string
+	options    client.HandleOptions
+	deliveries chan *client.Delivery
+
+	// attempts to handle messages not yet acknowledged
+	amtx     sync.Mutex
+	attempts map[attempt]int
+}
+
+// message ids are unique per server
+type attempt struct {
+	addr string
+	id   int64
+}
+
+// internal consume stream to a server
+type consumeStream struct {
+	sync.Mutex
+	addr   string
+	stream pb.MQ_ConsumeClient
+}
+
+// send sends the request on the current stream
+func (s *consumeStream) send(req *pb.ConsumeRequest) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.stream == nil {
+		return errors.New("stream closed")
+	}
+	return s.stream.Send(req)
+}
+
+// attempt records the receipt of the message returning the attempt
+func (cs *consumer) attempt(addr string, id int64) int {
+	cs.amtx.Lock()
+	defer cs.amtx.Unlock()
+	a := attempt{addr, id}
+	cs.attempts[a]++
+	return cs.attempts[a]
+}
+
+// done forgets the attempts of an acknowledged message
+func (cs *consumer) done(addr string, id int64) {
+	cs.amtx.Lock()
+	delete(cs.attempts, attempt{addr, id})
+	cs.amtx.Unlock()
+}
+
+// consume opens a Consume stream to the server for the consumer group
+func (c *grpcClient) consume(addr string, cs *consumer) (pb.MQ_ConsumeClient, context.CancelFunc, error) {
+	conn, err := c.conn(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(c.context(context.Background()))
+
+	stream, err := pb.NewMQClient(conn).Consume(ctx)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	if err := stream.Send(&pb.ConsumeRequest{
+		Topic:       cs.topic,
+		Group:       cs.options.Group,
+		MaxInflight: int32(cs.options.Concurrency),
+	}); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	// end the stream once the handler stops
+	go func() {
+		select {
+		case <-cs.exit:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	return stream, cancel, nil
+}
+
+// deliver sends messages received on the stream to the
+// handler until the stream fails or the consumer exits
+func (c *grpcClient) deliver(s *consumeStream, cs *consumer) error {
+	for {
+		rsp, err := s.stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		c.receive(rsp.Topic, rsp.Headers)
+
+		id := rsp.Id
+		d := &client.Delivery{
+			Message: &client.Message{
+				Id:        rsp.Id,
+				Topic:     rsp.Topic,
+				Payload:   rsp.Payload,
+				Headers:   rsp.Headers,
+				Timestamp: rsp.Timestamp,
+				Attempt:   cs.attempt(s.addr, id),
+			},
+			Ack: func() error {
+				cs.done(s.addr, id)
+				return s.send(&pb.ConsumeRequest{Ack: []int64{id}})
+			},
+			Nack: func() error {
+				return s.send(&pb.ConsumeRequest{Nack: []int64{id}})
+			},
+		}
+
+		select {
+		case cs.deliveries <- d:
+		case <-cs.exit:
+			return nil
+		}
+	}
+}
+
+// grpcConsume consumes from the server reopening the stream if it fails.
+// Messages not acknowledged are delivered again by the server.
+func (c *grpcClient) grpcConsume(addr string, cs *consumer) error {
+	stream, cancel, err := c.consume(addr, cs)
+	if err != nil {
+		return err
+	}
+
+	s := &consumeStream{addr: addr, stream: stream}
+
+	cs.wg.Add(1)
+
+	go func() {
+		defer cs.wg.Done()
+
+		for {
+			err := c.deliver(s, cs)
+
+			select {
+			case <-cs.exit:
+				cancel()
+				return
+			default:
+			}
+
+			cancel()
+
+			s.Lock()
+			s.stream = nil
+			s.Unlock()
+
+			ok := client.Resubscribe(c.options, cs.topic, addr, err, cs.exit, func() error {
+				stream, cc, err := c.consume(addr, cs)
+				if err != nil {
+					return err
+				}
+				cancel = cc
+				s.Lock()
+				s.stream = stream
+				s.Unlock()
+				return nil
+			})
+			if !ok {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// close ends the streams of the consumer
+func (cs *consumer) close() {
+	select {
+	case <-cs.exit:
+	default:
+		close(cs.exit)
+		cs.wg.Wait()
+	}
+}
+
+// Handle calls fn for messages consumed from the topic by the consumer
+// group. Messages are acknowledged when fn returns nil and delivered
+// again by the server if it returns an error.
+func (c *grpcClient) Handle(topic string, fn client.HandlerFunc, opts ...client.HandleOption) (*client.Handler, error) {
+	select {
+	case <-c.exit:
+		return nil, errors.New("client closed")
+	default:
+	}
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	servers, err := c.options.Selector.Get(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	h := client.NewHandler(fn, append([]client.HandleOption{client.HandleLogger(c.options.Logger)}, opts...)...)
+
+	cs := &consumer{
+		exit:       make(chan bool),
+		topic:      topic,
+		options:    h.Options(),
+		deliveries: make(chan *client.Delivery),
+		attempts:   make(map[attempt]int),
+	}
+
+	var n int
+	var grr error
+	for _, addr := range servers {
+		for i := 0; i < 1+c.options.Retries; i++ {
+			err := c.grpcConsume(addr, cs)
+			if err == nil {
+				n++
+				break
+			}
+			c.options.Logger.Warn("Consume failed", "server", addr, "topic", topic, "attempt", i+1, "error", err)
+			grr = err
+		}
+	}
+
+	if n == 0 && grr != nil {
+		cs.close()
+		return nil, grr
+	}
+
+	c.Lock()
+	c.handlers[h] = true
+	c.Unlock()
+
+	// the streams stay open until handlers in flight are acknowledged
+	h.Serve(cs.deliveries, func() {
+		c.Lock()
+		delete(c.handlers, h)
+		c.Unlock()
+		cs.close()
+	})
+
+	return h, grr
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"errors"
+	"sync"
+
+	pb "github.com/asim/emque/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// publisher publishes messages to a server over a PubStream
+// matching acknowledgements to messages by sequence number
+type publisher struct {
+	stream pb.MQ_PubStreamClient
+	cancel context.CancelFunc
+
+	// serialises sending on the stream
+	send sync.Mutex
+
+	sync.Mutex
+	seq     int64
+	pending map[int64]chan error
+	// set once the stream fails
+	err error
+}
+
+// publish sends the message and waits for the acknowledgement
+// until the context is done
+func (p *publisher) publish(ctx context.Context, req *pb.PubRequest) error {
+	ch := make(chan error, 1)
+
+	p.Lock()
+	if p.err != nil {
+		p.Unlock()
+		return p.err
+	}
+	p.seq++
+	req.Seq = p.seq
+	p.pending[req.Seq] = ch
+	p.Unlock()
+
+	p.send.Lock()
+	err := p.stream.Send(req)
+	p.send.Unlock()
+
+	if err != nil {
+		p.close(err)
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		p.Lock()
+		delete(p.pending, req.Seq)
+		p.Unlock()
+		return ctx.Err()
+	}
+}
+
+// recv delivers acknowledgements until the stream fails
+func (p *publisher) recv() {
+	for {
+		ack, err := p.stream.Recv()
+		if err != nil {
+			p.close(err)
+			return
+		}
+
+		p.Lock()
+		ch, ok := p.pending[ack.Seq]
+		delete(p.pending, ack.Seq)
+		p.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		if len(ack.Error) > 0 {
+			ch <- errors.New(ack.Error)
+		} else {
+			ch <- nil
+		}
+	}
+}
+
+// close fails pending messages with the error and ends the stream
+func (p *publisher) close(err error) {
+	p.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	err = p.err
+	pending := p.pending
+	p.pending = make(map[int64]chan error)
+	p.Unlock()
+
+	for _, ch := range pending {
+		ch <- err
+	}
+
+	p.cancel()
+}
+
+// failed returns true if the stream can no longer be used
+func (p *publisher) failed() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.err != nil
+}
+
+// publisher returns the publish stream to the server, opening one on the
+// connection if none is open. Returns nil if the server does not support
+// streaming.
+func (c *grpcClient) publisher(addr string) (*publisher, error) {
+	c.pmtx.Lock()
+	defer c.pmtx.Unlock()
+
+	if c.unary[addr] {
+		return nil, nil
+	}
+
+	if p, ok := c.publishers[addr]; ok && !p.failed() {
+		return p, nil
+	}
+
+	conn, err := c.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(c.context(context.Background()))
+
+	stream, err := pb.NewMQClient(conn).PubStream(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	p := &publisher{
+		stream:  stream,
+		cancel:  cancel,
+		pending: make(map[int64]chan error),
+	}
+	go p.recv()
+
+	c.publishers[addr] = p
+	return p, nil
+}
+
+// streamPublish publishes over the stream to the server. Servers which do
+// not implement PubStream are remembered and published to via Pub.
+func (c *grpcClient) streamPublish(ctx context.Context, addr string, req *pb.PubRequest) (bool, error) {
+	p, err := c.publisher(addr)
+	if err != nil {
+		return true, err
+	}
+	if p == nil {
+		return false, nil
+	}
+
+	err = p.publish(ctx, req)
+	if status.Code(err) == codes.Unimplemented {
+		c.pmtx.Lock()
+		c.unary[addr] = true
+		c.pmtx.Unlock()
+		return false, nil
+	}
+
+	return true, err
+}
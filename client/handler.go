@@ -0,0 +1,231 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/asim/emque/logger"
+)
+
+// Message is a message received by a handler
+type Message struct {
+	Id        int64
+	Topic     string
+	Payload   []byte
+	Headers   map[string]string
+	Timestamp int64
+	// Attempt to handle the message starting at 1
+	Attempt int
+}
+
+// HandlerFunc handles a message. Returning nil acknowledges
+// the message and an error nacks it so it is delivered again.
+type HandlerFunc func(ctx context.Context, m *Message) error
+
+// Delivery is a message received by a client with
+// functions to acknowledge it or deliver it again
+type Delivery struct {
+	Message *Message
+	Ack     func() error
+	Nack    func() error
+}
+
+// Handler calls a HandlerFunc for deliveries with a pool of workers
+type Handler struct {
+	options HandleOptions
+	fn      HandlerFunc
+
+	// cancelled if handlers do not complete in time on stop
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	once sync.Once
+	// closed on stop
+	exit chan bool
+	// stops the source once
+	stopOnce sync.Once
+	// closed once the workers exit
+	done chan bool
+	// stops the source of deliveries
+	stop func()
+}
+
+// call calls the handler recovering panics
+func (h *Handler) call(m *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.options.Logger.Error("Panic handling message", "topic", m.Topic, "id", m.Id, "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h.fn(h.ctx, m)
+}
+
+// handle calls the handler acknowledging the message if handled.
+// Failed messages are delivered again after a backoff and dropped
+// once the max attempts are reached.
+func (h *Handler) handle(d *Delivery) {
+	m := d.Message
+
+	err := h.call(m)
+	if err == nil {
+		if err := d.Ack(); err != nil {
+			h.options.Logger.Warn("Failed to ack message", "topic", m.Topic, "id", m.Id, "error", err)
+		}
+		return
+	}
+
+	if h.options.MaxAttempts > 0 && m.Attempt >= h.options.MaxAttempts {
+		h.options.Logger.Error("Dropping message", "topic", m.Topic, "id", m.Id, "attempt", m.Attempt, "error", err)
+		d.Ack()
+		return
+	}
+
+	h.options.Logger.Warn("Failed to handle message", "topic", m.Topic, "id", m.Id, "attempt", m.Attempt, "error", err)
+
+	// unacknowledged messages are left to the server once stopped
+	go func() {
+		t := time.NewTimer(Backoff(m.Attempt, h.options.MinBackoff, h.options.MaxBackoff))
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-h.exit:
+			return
+		}
+
+		if err := d.Nack(); err != nil {
+			h.options.Logger.Warn("Failed to nack message", "topic", m.Topic, "id", m.Id, "error", err)
+		}
+	}()
+}
+
+// work handles deliveries until stopped
+func (h *Handler) work(ch <-chan *Delivery) {
+	for {
+		select {
+		case <-h.exit:
+			return
+		default:
+		}
+
+		select {
+		case d, ok := <-ch:
+			if !ok {
+				return
+			}
+			h.handle(d)
+		case <-h.exit:
+			return
+		}
+	}
+}
+
+// Serve handles deliveries received on the channel with the configured
+// number of workers. Stop is called once the workers exit on stop.
+func (h *Handler) Serve(ch <-chan *Delivery, stop func()) {
+	h.stop = stop
+
+	var wg sync.WaitGroup
+	for i := 0; i < h.options.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.work(ch)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(h.done)
+	}()
+}
+
+// Options returns the options of the handler
+func (h *Handler) Options() HandleOptions {
+	return h.options
+}
+
+// Stop stops receiving messages and waits for handlers in flight to
+// complete. Handlers are cancelled if the context is done first.
+func (h *Handler) Stop(ctx context.Context) error {
+	h.once.Do(func() {
+		close(h.exit)
+	})
+
+	var err error
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		h.cancel()
+		err = ctx.Err()
+	}
+
+	h.stopOnce.Do(func() {
+		if h.stop != nil {
+			h.stop()
+		}
+	})
+	return err
+}
+
+// redeliver returns a delivery for servers without acknowledgements.
+// Ack is a no-op and Nack sends the message on the channel again.
+func redeliver(ch chan<- *Delivery, m *Message, exit <-chan bool) *Delivery {
+	return &Delivery{
+		Message: m,
+		Ack: func() error {
+			return nil
+		},
+		Nack: func() error {
+			n := *m
+			n.Attempt++
+
+			go func() {
+				select {
+				case ch <- redeliver(ch, &n, exit):
+				case <-exit:
+				}
+			}()
+			return nil
+		},
+	}
+}
+
+// NewHandler returns a handler calling fn for deliveries passed to Serve
+func NewHandler(fn HandlerFunc, opts ...HandleOption) *Handler {
+	options := HandleOptions{
+		Concurrency: 1,
+		Group:       "default",
+		MaxAttempts: 10,
+		MinBackoff:  MinBackoff,
+		MaxBackoff:  MaxBackoff,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if options.Concurrency <= 0 {
+		options.Concurrency = 1
+	}
+
+	if options.Logger == nil {
+		options.Logger = logger.Default
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Handler{
+		options: options,
+		fn:      fn,
+		ctx:     ctx,
+		cancel:  cancel,
+		exit:    make(chan bool),
+		done:    make(chan bool),
+	}
+}
@@ -0,0 +1,262 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asim/emque/logger"
+)
+
+var discard = HandleLogger(logger.New(logger.WithOutput(ioutil.Discard)))
+
+func TestHandlerConcurrency(t *testing.T) {
+	testCases := []struct {
+		name        string
+		concurrency int
+		expected    int
+	}{
+		{"single", 1, 1},
+		{"pool", 4, 4},
+		{"default", 0, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mtx sync.Mutex
+			var active, max int
+			release := make(chan bool)
+
+			h := NewHandler(func(ctx context.Context, m *Message) error {
+				mtx.Lock()
+				active++
+				if active > max {
+					max = active
+				}
+				mtx.Unlock()
+
+				<-release
+
+				mtx.Lock()
+				active--
+				mtx.Unlock()
+				return nil
+			}, Concurrency(tc.concurrency), discard)
+
+			ch := make(chan *Delivery, 10)
+			for i := 0; i < 10; i++ {
+				ch <- redeliver(ch, &Message{Id: int64(i), Attempt: 1}, h.exit)
+			}
+
+			h.Serve(ch, nil)
+
+			running := func() int {
+				mtx.Lock()
+				defer mtx.Unlock()
+				return active
+			}
+
+			for i := 0; running() != tc.expected; i++ {
+				if i > 100 {
+					t.Fatalf("expected %d handlers running got %d", tc.expected, running())
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+
+			// no more workers than the concurrency
+			time.Sleep(time.Millisecond * 50)
+			close(release)
+
+			if err := h.Stop(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if max != tc.expected {
+				t.Fatalf("expected at most %d handlers running got %d", tc.expected, max)
+			}
+		})
+	}
+}
+
+func TestHandlerDelivery(t *testing.T) {
+	testCases := []struct {
+		name        string
+		fn          HandlerFunc
+		attempt     int
+		maxAttempts int
+		acked       bool
+		nacked      bool
+	}{
+		{
+			name: "handled",
+			fn: func(ctx context.Context, m *Message) error {
+				return nil
+			},
+			attempt:     1,
+			maxAttempts: 3,
+			acked:       true,
+		},
+		{
+			name: "failed",
+			fn: func(ctx context.Context, m *Message) error {
+				return errors.New("failed")
+			},
+			attempt:     1,
+			maxAttempts: 3,
+			nacked:      true,
+		},
+		{
+			name: "panic",
+			fn: func(ctx context.Context, m *Message) error {
+				panic("handler panic")
+			},
+			attempt:     1,
+			maxAttempts: 3,
+			nacked:      true,
+		},
+		{
+			name: "max attempts",
+			fn: func(ctx context.Context, m *Message) error {
+				return errors.New("failed")
+			},
+			attempt:     3,
+			maxAttempts: 3,
+			acked:       true,
+		},
+		{
+			name: "unlimited attempts",
+			fn: func(ctx context.Context, m *Message) error {
+				return errors.New("failed")
+			},
+			attempt:     100,
+			maxAttempts: 0,
+			nacked:      true,
+		},
+	}
+
+	backoff := time.Millisecond * 20
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHandler(tc.fn, MaxAttempts(tc.maxAttempts), HandleBackoff(backoff, backoff), discard)
+
+			acked := make(chan time.Time, 1)
+			nacked := make(chan time.Time, 1)
+
+			ch := make(chan *Delivery, 1)
+			ch <- &Delivery{
+				Message: &Message{Id: 1, Topic: "foo", Attempt: tc.attempt},
+				Ack: func() error {
+					acked <- time.Now()
+					return nil
+				},
+				Nack: func() error {
+					nacked <- time.Now()
+					return nil
+				},
+			}
+
+			start := time.Now()
+			h.Serve(ch, nil)
+			defer h.Stop(context.Background())
+
+			select {
+			case <-acked:
+				if !tc.acked {
+					t.Fatal("unexpected ack")
+				}
+			case n := <-nacked:
+				if !tc.nacked {
+					t.Fatal("unexpected nack")
+				}
+				// nacked after half the backoff at least
+				if d := n.Sub(start); d < backoff/2 {
+					t.Fatalf("expected nack after %v got %v", backoff/2, d)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for ack or nack")
+			}
+		})
+	}
+}
+
+func TestHandlerStop(t *testing.T) {
+	handled := make(chan bool)
+
+	h := NewHandler(func(ctx context.Context, m *Message) error {
+		close(handled)
+		return errors.New("failed")
+	}, HandleBackoff(time.Second, time.Second), discard)
+
+	nacked := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	ch := make(chan *Delivery, 1)
+	ch <- &Delivery{
+		Message: &Message{Id: 1, Topic: "foo", Attempt: 1},
+		Ack: func() error {
+			return nil
+		},
+		Nack: func() error {
+			nacked <- true
+			return nil
+		},
+	}
+
+	h.Serve(ch, func() {
+		close(stopped)
+	})
+
+	<-handled
+
+	if err := h.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("expected the source to be stopped")
+	}
+
+	// pending nacks are left to the server once stopped
+	select {
+	case <-nacked:
+		t.Fatal("unexpected nack after stop")
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestHandlerStopTimeout(t *testing.T) {
+	started := make(chan bool)
+	cancelled := make(chan bool)
+
+	h := NewHandler(func(ctx context.Context, m *Message) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	}, discard)
+
+	ch := make(chan *Delivery, 1)
+	ch <- redeliver(ch, &Message{Id: 1, Attempt: 1}, h.exit)
+
+	h.Serve(ch, nil)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	if err := h.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded got %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the handler context to be cancelled")
+	}
+}
@@ -2,15 +2,20 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/trace"
 	"github.com/gorilla/websocket"
 )
 
@@ -18,17 +23,42 @@ import (
 type httpClient struct {
 	exit    chan bool
 	options Options
+	err     error
+
+	httpc *http.Client
+	wsd   *websocket.Dialer
+
+	mtx     sync.Mutex
+	sockets map[string]*socket
 
 	sync.RWMutex
 	subscribers map[<-chan []byte]*subscriber
+	handlers    map[*Handler]bool
 }
 
 // internal subscriber
 type subscriber struct {
 	wg    sync.WaitGroup
+	ctx   context.Context
 	ch    chan<- []byte
 	exit  chan bool
 	topic string
+	// messages are delivered to handlers if set
+	deliveries chan *Delivery
+}
+
+// internal message sent by servers as JSON
+type message struct {
+	Id      int64             `json:"id"`
+	Topic   string            `json:"topic"`
+	Payload []byte            `json:"payload"`
+	Headers map[string]string `json:"headers"`
+}
+
+// internal unix domain socket transport
+type socket struct {
+	httpc *http.Client
+	wsd   *websocket.Dialer
 }
 
 // internal select all
@@ -37,8 +67,8 @@ type all struct {
 	servers []string
 }
 
-var (
-	httpc = &http.Client{
+func newHTTPTransport(config *tls.Config) *http.Client {
+	return &http.Client{
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 			Dial: (&net.Dialer{
@@ -46,26 +76,92 @@ var (
 				KeepAlive: 30 * time.Second,
 			}).Dial,
 			TLSHandshakeTimeout: 10 * time.Second,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+			TLSClientConfig:     config,
 		},
 	}
+}
+
+func newWSDialer(config *tls.Config) *websocket.Dialer {
+	return &websocket.Dialer{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}
+}
 
-	wsd = &websocket.Dialer{
-		Proxy: http.ProxyFromEnvironment,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
+func newSocket(path string) *socket {
+	dial := func(network, addr string) (net.Conn, error) {
+		return net.DialTimeout("unix", path, 30*time.Second)
+	}
+
+	return &socket{
+		httpc: &http.Client{
+			Transport: &http.Transport{
+				Dial: dial,
+			},
+		},
+		wsd: &websocket.Dialer{
+			NetDial: dial,
 		},
 	}
-)
+}
+
+// address returns the url for a server address
+func address(addr string, insecure bool) string {
+	if strings.HasPrefix(addr, "http") || strings.HasPrefix(addr, "unix://") {
+		return addr
+	}
+	if insecure {
+		return fmt.Sprintf("http://%s", addr)
+	}
+	return fmt.Sprintf("https://%s", addr)
+}
 
-func publish(addr, topic string, payload []byte) error {
+// transport returns the base url and clients used for the address
+func (c *httpClient) transport(addr string) (string, *http.Client, *websocket.Dialer) {
+	if !strings.HasPrefix(addr, "unix://") {
+		return addr, c.httpc, c.wsd
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	s, ok := c.sockets[addr]
+	if !ok {
+		s = newSocket(strings.TrimPrefix(addr, "unix://"))
+		c.sockets[addr] = s
+	}
+
+	// the host is ignored when dialing the socket
+	return "http://unix", s.httpc, s.wsd
+}
+
+func (c *httpClient) publish(ctx context.Context, addr, topic string, payload []byte) error {
+	_, span := c.options.Tracer.Start(ctx, "publish")
+	defer span.End()
+	span.SetAttribute("topic", topic)
+
+	addr, httpc, _ := c.transport(addr)
 	url := fmt.Sprintf("%s/pub?topic=%s", addr, topic)
-	rsp, err := httpc.Post(url, "application/json", bytes.NewBuffer(payload))
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
+
+	hdr := make(map[string]string)
+	trace.Inject(span.Context(), hdr)
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	if len(c.options.Namespace) > 0 {
+		req.Header.Set(NamespaceHeader, c.options.Namespace)
+	}
+
+	rsp, err := httpc.Do(req.WithContext(ctx))
+	if err != nil {
+		span.SetError(err)
+		return err
+	}
 	rsp.Body.Close()
 	if rsp.StatusCode != 200 {
 		return fmt.Errorf("Non 200 response %d", rsp.StatusCode)
@@ -73,39 +169,237 @@ func publish(addr, topic string, payload []byte) error {
 	return nil
 }
 
-func subscribe(addr string, s *subscriber) error {
+// inject returns the message headers with the trace context
+func inject(span trace.Span, hdr map[string]string) map[string]string {
+	if _, ok := hdr[trace.TraceparentHeader]; ok {
+		return hdr
+	}
+	h := make(map[string]string, len(hdr)+2)
+	for k, v := range hdr {
+		h[k] = v
+	}
+	trace.Inject(span.Context(), h)
+	return h
+}
+
+// publishBatch publishes the messages to the batch endpoint falling
+// back to publishing each message if the server does not support it
+func (c *httpClient) publishBatch(ctx context.Context, addr string, msgs []*Message) ([]error, error) {
+	ctx, span := c.options.Tracer.Start(ctx, "publish")
+	defer span.End()
+	span.SetAttribute("messages", strconv.Itoa(len(msgs)))
+
+	batch := make([]*message, len(msgs))
+	for i, m := range msgs {
+		batch[i] = &message{
+			Topic:   m.Topic,
+			Payload: m.Payload,
+			Headers: inject(span, m.Headers),
+		}
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"messages": batch,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	url, httpc, _ := c.transport(addr)
+	req, err := http.NewRequest("POST", url+"/batch", bytes.NewBuffer(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.options.Namespace) > 0 {
+		req.Header.Set(NamespaceHeader, c.options.Namespace)
+	}
+
+	rsp, err := httpc.Do(req.WithContext(ctx))
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	// older servers do not support batches
+	if rsp.StatusCode == 404 {
+		errs := make([]error, len(msgs))
+		for i, m := range msgs {
+			errs[i] = c.publish(ctx, addr, m.Topic, m.Payload)
+		}
+		return errs, nil
+	}
+
+	if rsp.StatusCode != 200 {
+		return nil, fmt.Errorf("Non 200 response %d", rsp.StatusCode)
+	}
+
+	var res struct {
+		Errors []string `json:"errors"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if len(res.Errors) != len(msgs) {
+		return nil, fmt.Errorf("expected %d results got %d", len(msgs), len(res.Errors))
+	}
+
+	errs := make([]error, len(msgs))
+	for i, e := range res.Errors {
+		if len(e) > 0 {
+			errs[i] = errors.New(e)
+		}
+	}
+	return errs, nil
+}
+
+func (c *httpClient) ping(addr string) error {
+	addr, httpc, _ := c.transport(addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PingTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", addr+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := httpc.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != 200 {
+		return fmt.Errorf("Non 200 response %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+// dial opens a websocket to the server subscribing to the topic and
+// replaying persisted messages from the offset if greater than zero
+func (c *httpClient) dial(ctx context.Context, addr, topic string, offset int64) (*websocket.Conn, bool, error) {
+	addr, _, wsd := c.transport(addr)
+
 	if strings.HasPrefix(addr, "http") {
 		addr = strings.TrimPrefix(addr, "http")
 		addr = "ws" + addr
 	}
 
-	url := fmt.Sprintf("%s/sub?topic=%s", addr, s.topic)
-	c, _, err := wsd.Dial(url, make(http.Header))
+	hdr := make(http.Header)
+	if len(c.options.Namespace) > 0 {
+		hdr.Set(NamespaceHeader, c.options.Namespace)
+	}
+
+	url := fmt.Sprintf("%s/sub?topic=%s&format=json", addr, topic)
+	if offset > 0 {
+		url = fmt.Sprintf("%s&offset=%d", url, offset)
+	}
+
+	conn, rsp, err := wsd.DialContext(ctx, url, hdr)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
+	// older servers send raw payloads
+	return conn, rsp.Header.Get("X-Emque-Format") == "json", nil
+}
+
+// read sends messages received on the websocket to the subscriber until
+// the connection fails or the subscriber exits, recording the last id
+func (c *httpClient) read(conn *websocket.Conn, encoded bool, s *subscriber, last *int64) error {
+	done := make(chan bool)
+	defer close(done)
+
 	go func() {
 		select {
 		case <-s.exit:
-			c.Close()
+			conn.Close()
+		case <-done:
 		}
 	}()
 
+	for {
+		t, p, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if t == websocket.CloseMessage {
+			return errors.New("connection closed")
+		}
+
+		m := &message{Topic: s.topic, Payload: p}
+
+		if encoded {
+			m = new(message)
+			if err := json.Unmarshal(p, m); err != nil {
+				continue
+			}
+			c.receive(m.Topic, m.Headers)
+			*last = m.Id
+		}
+
+		if s.deliveries != nil {
+			d := redeliver(s.deliveries, &Message{
+				Id:      m.Id,
+				Topic:   m.Topic,
+				Payload: m.Payload,
+				Headers: m.Headers,
+				Attempt: 1,
+			}, s.exit)
+
+			select {
+			case s.deliveries <- d:
+			case <-s.exit:
+				return nil
+			}
+			continue
+		}
+
+		select {
+		case s.ch <- m.Payload:
+		case <-s.exit:
+			return nil
+		}
+	}
+}
+
+// subscribe subscribes to the server resubscribing after
+// the last message received if the connection drops
+func (c *httpClient) subscribe(addr string, s *subscriber) error {
+	conn, encoded, err := c.dial(s.ctx, addr, s.topic, 0)
+	if err != nil {
+		return err
+	}
+
+	s.wg.Add(1)
+
 	go func() {
 		defer s.wg.Done()
 
+		// id of the last message received
+		var last int64
+
 		for {
-			t, p, err := c.ReadMessage()
-			if err != nil || t == websocket.CloseMessage {
-				c.Close()
-				return
-			}
+			err := c.read(conn, encoded, s, &last)
+			conn.Close()
 
 			select {
-			case s.ch <- p:
 			case <-s.exit:
-				c.Close()
+				return
+			default:
+			}
+
+			ok := Resubscribe(c.options, s.topic, addr, err, s.exit, func() error {
+				var offset int64
+				if last > 0 {
+					offset = last + 1
+				}
+				var err error
+				conn, encoded, err = c.dial(s.ctx, addr, s.topic, offset)
+				return err
+			})
+			if !ok {
 				return
 			}
 		}
@@ -114,6 +408,14 @@ func subscribe(addr string, s *subscriber) error {
 	return nil
 }
 
+// receive records the receipt of a message
+func (c *httpClient) receive(topic string, headers map[string]string) {
+	ctx := trace.ExtractContext(context.Background(), headers)
+	_, span := c.options.Tracer.Start(ctx, "receive")
+	span.SetAttribute("topic", topic)
+	span.End()
+}
+
 func (sa *all) Get(topic string) ([]string, error) {
 	sa.RLock()
 	if len(sa.servers) == 0 {
@@ -153,9 +455,7 @@ func (c *httpClient) run() {
 					continue
 				}
 				for i, ip := range ips {
-					if !strings.HasPrefix(ip, "http") {
-						ips[i] = fmt.Sprintf("https://%s", ip)
-					}
+					ips[i] = address(ip, c.options.Insecure)
 				}
 				servers = append(servers, ips...)
 			}
@@ -176,6 +476,19 @@ func (c *httpClient) Close() error {
 		return nil
 	default:
 		close(c.exit)
+
+		// wait for handlers in flight
+		c.RLock()
+		var handlers []*Handler
+		for h := range c.handlers {
+			handlers = append(handlers, h)
+		}
+		c.RUnlock()
+
+		for _, h := range handlers {
+			h.Stop(context.Background())
+		}
+
 		c.Lock()
 		for _, sub := range c.subscribers {
 			sub.Close()
@@ -186,12 +499,20 @@ func (c *httpClient) Close() error {
 }
 
 func (c *httpClient) Publish(topic string, payload []byte) error {
+	return c.PublishContext(context.Background(), topic, payload)
+}
+
+func (c *httpClient) PublishContext(ctx context.Context, topic string, payload []byte) error {
 	select {
 	case <-c.exit:
 		return errors.New("client closed")
 	default:
 	}
 
+	if c.err != nil {
+		return c.err
+	}
+
 	servers, err := c.options.Selector.Get(topic)
 	if err != nil {
 		return err
@@ -200,49 +521,172 @@ func (c *httpClient) Publish(topic string, payload []byte) error {
 	var grr error
 	for _, addr := range servers {
 		for i := 0; i < 1+c.options.Retries; i++ {
-			err := publish(addr, topic, payload)
+			// don't retry once the context is done
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err := c.publish(ctx, addr, topic, payload)
 			if err == nil {
 				break
 			}
+			c.options.Logger.Warn("Publish failed", "server", addr, "topic", topic, "attempt", i+1, "error", err)
 			grr = err
 		}
 	}
 	return grr
 }
 
+func (c *httpClient) PublishBatch(ctx context.Context, msgs []*Message) []error {
+	errs := make([]error, len(msgs))
+
+	var err error
+	select {
+	case <-c.exit:
+		err = errors.New("client closed")
+	default:
+		err = c.err
+	}
+
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	return Batch(ctx, c.options, msgs, c.publishBatch)
+}
+
+// Ping checks all servers are reachable
+func (c *httpClient) Ping() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	for _, addr := range c.options.Servers {
+		if err := c.ping(addr); err != nil {
+			return fmt.Errorf("server %s unreachable: %v", addr, err)
+		}
+	}
+	return nil
+}
+
 func (c *httpClient) Subscribe(topic string) (<-chan []byte, error) {
+	return c.SubscribeContext(context.Background(), topic)
+}
+
+func (c *httpClient) SubscribeContext(ctx context.Context, topic string) (<-chan []byte, error) {
 	select {
 	case <-c.exit:
 		return nil, errors.New("client closed")
 	default:
 	}
 
-	servers, err := c.options.Selector.Get(topic)
-	if err != nil {
-		return nil, err
+	if c.err != nil {
+		return nil, c.err
 	}
 
 	ch := make(chan []byte, len(c.options.Servers)*256)
 
 	s := &subscriber{
+		ctx:   ctx,
 		ch:    ch,
 		exit:  make(chan bool),
 		topic: topic,
 	}
 
+	_, grr := c.subscribeAll(s)
+	if err := ctx.Err(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	c.Lock()
+	c.subscribers[ch] = s
+	c.Unlock()
+
+	// unsubscribe when the context is done
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.Unsubscribe(ch)
+			case <-s.exit:
+			}
+		}()
+	}
+
+	return ch, grr
+}
+
+// subscribeAll subscribes to every server selected for the topic
+// returning the number of servers subscribed to
+func (c *httpClient) subscribeAll(s *subscriber) (int, error) {
+	servers, err := c.options.Selector.Get(s.topic)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
 	var grr error
 	for _, addr := range servers {
 		for i := 0; i < 1+c.options.Retries; i++ {
-			err := subscribe(addr, s)
+			if err := s.ctx.Err(); err != nil {
+				return n, err
+			}
+			err := c.subscribe(addr, s)
 			if err == nil {
-				s.wg.Add(1)
+				n++
 				break
 			}
+			c.options.Logger.Warn("Subscribe failed", "server", addr, "topic", s.topic, "attempt", i+1, "error", err)
 			grr = err
 		}
 	}
+	return n, grr
+}
 
-	return ch, grr
+// Handle calls fn for messages received on the topic. Servers over http
+// do not support acknowledgements so messages are nacked by delivering
+// them to the handler again and are lost if the client exits.
+func (c *httpClient) Handle(topic string, fn HandlerFunc, opts ...HandleOption) (*Handler, error) {
+	select {
+	case <-c.exit:
+		return nil, errors.New("client closed")
+	default:
+	}
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	h := NewHandler(fn, append([]HandleOption{HandleLogger(c.options.Logger)}, opts...)...)
+
+	s := &subscriber{
+		ctx:        context.Background(),
+		exit:       make(chan bool),
+		topic:      topic,
+		deliveries: make(chan *Delivery),
+	}
+
+	n, grr := c.subscribeAll(s)
+	if n == 0 && grr != nil {
+		s.Close()
+		return nil, grr
+	}
+
+	c.Lock()
+	c.handlers[h] = true
+	c.Unlock()
+
+	h.Serve(s.deliveries, func() {
+		c.Lock()
+		delete(c.handlers, h)
+		c.Unlock()
+		s.Close()
+	})
+
+	return h, grr
 }
 
 func (c *httpClient) Unsubscribe(ch <-chan []byte) error {
@@ -253,8 +697,11 @@ func (c *httpClient) Unsubscribe(ch <-chan []byte) error {
 	}
 
 	c.Lock()
-	defer c.Unlock()
-	if sub, ok := c.subscribers[ch]; ok {
+	sub, ok := c.subscribers[ch]
+	delete(c.subscribers, ch)
+	c.Unlock()
+
+	if ok {
 		return sub.Close()
 	}
 	return nil
@@ -273,32 +720,49 @@ func (s *subscriber) Close() error {
 // newHTTPClient returns a http Client
 func newHTTPClient(opts ...Option) *httpClient {
 	options := Options{
-		Selector: new(all),
-		Servers:  Servers,
-		Retries:  Retries,
+		Selector:           new(all),
+		Servers:            Servers,
+		Retries:            Retries,
+		InsecureSkipVerify: InsecureSkipVerify,
+		Resubscribe:        true,
+		MinBackoff:         MinBackoff,
+		MaxBackoff:         MaxBackoff,
 	}
 
 	for _, o := range opts {
 		o(&options)
 	}
 
+	if options.Tracer == nil {
+		options.Tracer = trace.Default
+	}
+
+	if options.Logger == nil {
+		options.Logger = logger.Default
+	}
+
 	var servers []string
 
 	for _, addr := range options.Servers {
-		if !strings.HasPrefix(addr, "http") {
-			addr = fmt.Sprintf("https://%s", addr)
-		}
-		servers = append(servers, addr)
+		servers = append(servers, address(addr, options.Insecure))
 	}
 
 	// set servers
 	WithServers(servers...)(&options)
 	options.Selector.Set(options.Servers...)
 
+	// errors are returned on publish and subscribe
+	config, err := TLSConfig(options)
+
 	c := &httpClient{
 		exit:        make(chan bool),
 		options:     options,
+		err:         err,
+		httpc:       newHTTPTransport(config),
+		wsd:         newWSDialer(config),
+		sockets:     make(map[string]*socket),
 		subscribers: make(map[<-chan []byte]*subscriber),
+		handlers:    make(map[*Handler]bool),
 	}
 	go c.run()
 	return c
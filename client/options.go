@@ -1,5 +1,12 @@
 package client
 
+import (
+	"time"
+
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/trace"
+)
+
 type Options struct {
 	// Number of retry attempts
 	Retries int
@@ -9,6 +16,36 @@ type Options struct {
 	Servers []string
 	// Selector
 	Selector Selector
+
+	// CA bundle used to verify servers
+	CAFile string
+	// Client certificate and key for mutual TLS
+	CertFile string
+	KeyFile  string
+	// Server name used to verify the server certificate
+	ServerName string
+	// Skip verification of the server certificate
+	InsecureSkipVerify bool
+	// Connect to servers in plaintext rather than TLS
+	Insecure bool
+
+	// Tracer records publish and receive spans
+	// and propagates the trace context
+	Tracer trace.Tracer
+	// Logger for retries and connection errors
+	Logger logger.Logger
+	// Namespace topics are published and subscribed to in
+	Namespace string
+
+	// Resubscribe when a subscription drops resuming
+	// after the last message received
+	Resubscribe bool
+	// Backoff between attempts to resubscribe
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// StateChange is called when a subscription drops and is
+	// resubscribed. It is called by the subscription so must not block.
+	StateChange func(Event)
 }
 
 type Option func(o *Options)
@@ -40,3 +77,202 @@ func WithServers(addrs ...string) Option {
 		o.Servers = addrs
 	}
 }
+
+// WithCA sets the CA bundle used to verify servers. Specifying
+// a CA enables verification of the server certificate.
+func WithCA(caFile string) Option {
+	return func(o *Options) {
+		o.CAFile = caFile
+		o.InsecureSkipVerify = false
+	}
+}
+
+// WithCertificate sets the client certificate used for mutual TLS
+func WithCertificate(certFile, keyFile string) Option {
+	return func(o *Options) {
+		o.CertFile = certFile
+		o.KeyFile = keyFile
+	}
+}
+
+// WithServerName overrides the server name used for verification
+func WithServerName(name string) Option {
+	return func(o *Options) {
+		o.ServerName = name
+	}
+}
+
+// WithInsecureSkipVerify toggles verification of the server certificate
+func WithInsecureSkipVerify(b bool) Option {
+	return func(o *Options) {
+		o.InsecureSkipVerify = b
+	}
+}
+
+// WithInsecure connects to servers in plaintext rather than TLS.
+// Unix domain sockets of the form unix:///path are always plaintext.
+func WithInsecure(b bool) Option {
+	return func(o *Options) {
+		o.Insecure = b
+	}
+}
+
+// WithTracer sets the tracer used to record spans
+func WithTracer(t trace.Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = t
+	}
+}
+
+// WithLogger sets the logger
+func WithLogger(l logger.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// WithNamespace selects the namespace on the server
+func WithNamespace(ns string) Option {
+	return func(o *Options) {
+		o.Namespace = ns
+	}
+}
+
+// WithResubscribe toggles resubscribing when a subscription drops
+func WithResubscribe(b bool) Option {
+	return func(o *Options) {
+		o.Resubscribe = b
+	}
+}
+
+// WithBackoff sets the backoff between attempts to resubscribe
+// which doubles from min up to max with jitter
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *Options) {
+		o.MinBackoff = min
+		o.MaxBackoff = max
+	}
+}
+
+// WithStateChange sets the function called when
+// a subscription drops and is resubscribed
+func WithStateChange(fn func(Event)) Option {
+	return func(o *Options) {
+		o.StateChange = fn
+	}
+}
+
+// HandleOptions configure a Handler
+type HandleOptions struct {
+	// Number of messages handled concurrently
+	Concurrency int
+	// Consumer group sharing the messages on servers supporting groups
+	Group string
+	// Max attempts to handle a message before it is dropped.
+	// Defaults to 10, negative for no limit.
+	MaxAttempts int
+	// Backoff before a failed message is delivered again
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Logger for handler errors and panics
+	Logger logger.Logger
+}
+
+type HandleOption func(o *HandleOptions)
+
+// Concurrency sets the number of messages handled concurrently
+func Concurrency(n int) HandleOption {
+	return func(o *HandleOptions) {
+		o.Concurrency = n
+	}
+}
+
+// Group sets the consumer group sharing the messages
+func Group(name string) HandleOption {
+	return func(o *HandleOptions) {
+		o.Group = name
+	}
+}
+
+// MaxAttempts sets the max attempts to handle a message before it is dropped
+func MaxAttempts(n int) HandleOption {
+	return func(o *HandleOptions) {
+		o.MaxAttempts = n
+	}
+}
+
+// HandleBackoff sets the backoff before a failed message is delivered again
+func HandleBackoff(min, max time.Duration) HandleOption {
+	return func(o *HandleOptions) {
+		o.MinBackoff = min
+		o.MaxBackoff = max
+	}
+}
+
+// HandleLogger sets the logger of the handler
+func HandleLogger(l logger.Logger) HandleOption {
+	return func(o *HandleOptions) {
+		o.Logger = l
+	}
+}
+
+// ProducerOptions configure a Producer
+type ProducerOptions struct {
+	// Max number of messages in a batch
+	BatchSize int
+	// Max payload bytes in a batch, zero for no limit
+	BatchBytes int
+	// Max time a message waits for the batch to fill
+	FlushInterval time.Duration
+	// Max number of messages buffered before Publish blocks
+	BufferSize int
+	// Max time to send a batch, zero for no limit
+	PublishTimeout time.Duration
+	// Callback is called with the result of each message. It
+	// is called by the producer so must not block.
+	Callback func(m *Message, err error)
+}
+
+type ProducerOption func(o *ProducerOptions)
+
+// BatchSize sets the max number of messages in a batch
+func BatchSize(n int) ProducerOption {
+	return func(o *ProducerOptions) {
+		o.BatchSize = n
+	}
+}
+
+// BatchBytes sets the max payload bytes in a batch
+func BatchBytes(n int) ProducerOption {
+	return func(o *ProducerOptions) {
+		o.BatchBytes = n
+	}
+}
+
+// FlushInterval sets the max time a message waits for the batch to fill
+func FlushInterval(d time.Duration) ProducerOption {
+	return func(o *ProducerOptions) {
+		o.FlushInterval = d
+	}
+}
+
+// BufferSize sets the max number of messages buffered before Publish blocks
+func BufferSize(n int) ProducerOption {
+	return func(o *ProducerOptions) {
+		o.BufferSize = n
+	}
+}
+
+// PublishTimeout sets the max time to send a batch
+func PublishTimeout(d time.Duration) ProducerOption {
+	return func(o *ProducerOptions) {
+		o.PublishTimeout = d
+	}
+}
+
+// Callback sets the function called with the result of each message
+func Callback(fn func(m *Message, err error)) ProducerOption {
+	return func(o *ProducerOptions) {
+		o.Callback = fn
+	}
+}
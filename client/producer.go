@@ -0,0 +1,299 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Producer publishes messages asynchronously in batches. Batches are
+// sent when full or once the flush interval passes.
+type Producer struct {
+	client  Client
+	options ProducerOptions
+
+	sync.RWMutex
+	closed bool
+	queue  chan *pending
+	// closed once the queue is flushed on close
+	done chan bool
+}
+
+// Future is the result of publishing a message asynchronously
+type Future struct {
+	done chan bool
+	err  error
+}
+
+// internal message waiting to be sent
+type pending struct {
+	msg    *Message
+	future *Future
+	// closed once the messages before it are sent
+	flush chan bool
+}
+
+// Done returns a channel closed once the message is published or fails
+func (f *Future) Done() <-chan bool {
+	return f.done
+}
+
+// Wait waits for the message to be published returning the error if any
+func (f *Future) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// Err returns the error publishing the message once done
+func (f *Future) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Batch publishes the messages to the servers selected for their topic
+// with a batch per server, retrying batches which fail to be sent.
+// Returns the error publishing each message, nil if published.
+func Batch(ctx context.Context, options Options, msgs []*Message, send func(ctx context.Context, addr string, msgs []*Message) ([]error, error)) []error {
+	errs := make([]error, len(msgs))
+
+	// indexes of the messages published to each server
+	batches := make(map[string][]int)
+	var servers []string
+
+	for i, m := range msgs {
+		addrs, err := options.Selector.Get(m.Topic)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		for _, addr := range addrs {
+			if _, ok := batches[addr]; !ok {
+				servers = append(servers, addr)
+			}
+			batches[addr] = append(batches[addr], i)
+		}
+	}
+
+	for _, addr := range servers {
+		batch := make([]*Message, len(batches[addr]))
+		for j, i := range batches[addr] {
+			batch[j] = msgs[i]
+		}
+
+		var berrs []error
+		var err error
+
+		for i := 0; i < 1+options.Retries; i++ {
+			// don't retry once the context is done
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			berrs, err = send(ctx, addr, batch)
+			if err == nil {
+				break
+			}
+			options.Logger.Warn("Publish batch failed", "server", addr, "messages", len(batch), "attempt", i+1, "error", err)
+		}
+
+		for j, i := range batches[addr] {
+			switch {
+			case err != nil:
+				errs[i] = err
+			case berrs[j] != nil:
+				errs[i] = berrs[j]
+			}
+		}
+	}
+
+	return errs
+}
+
+// send publishes the batch and completes the futures
+func (p *Producer) send(batch []*pending) {
+	msgs := make([]*Message, len(batch))
+	for i, b := range batch {
+		msgs[i] = b.msg
+	}
+
+	ctx := context.Background()
+	if p.options.PublishTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.options.PublishTimeout)
+		defer cancel()
+	}
+
+	errs := publishBatch(p.client, ctx, msgs)
+
+	for i, b := range batch {
+		b.future.err = errs[i]
+		close(b.future.done)
+
+		if p.options.Callback != nil {
+			p.options.Callback(b.msg, errs[i])
+		}
+	}
+}
+
+// run batches queued messages until the queue is closed
+func (p *Producer) run() {
+	defer close(p.done)
+
+	var batch []*pending
+	var size int
+
+	var timer *time.Timer
+	var flushC <-chan time.Time
+
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			flushC = nil
+		}
+		if len(batch) == 0 {
+			return
+		}
+		p.send(batch)
+		batch = nil
+		size = 0
+	}
+
+	for {
+		select {
+		case m, ok := <-p.queue:
+			if !ok {
+				flush()
+				return
+			}
+
+			if m.flush != nil {
+				flush()
+				close(m.flush)
+				continue
+			}
+
+			batch = append(batch, m)
+			size += len(m.msg.Payload)
+
+			// wait up to the interval from the first message
+			if len(batch) == 1 {
+				timer = time.NewTimer(p.options.FlushInterval)
+				flushC = timer.C
+			}
+
+			if len(batch) >= p.options.BatchSize || (p.options.BatchBytes > 0 && size >= p.options.BatchBytes) {
+				flush()
+			}
+		case <-flushC:
+			flushC = nil
+			flush()
+		}
+	}
+}
+
+// Options returns the options of the producer
+func (p *Producer) Options() ProducerOptions {
+	return p.options
+}
+
+// Publish queues the message returning a future completed once it is
+// published. Blocks while the buffer is full.
+func (p *Producer) Publish(topic string, payload []byte) *Future {
+	f := &Future{done: make(chan bool)}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	if p.closed {
+		f.err = errors.New("producer closed")
+		close(f.done)
+		return f
+	}
+
+	p.queue <- &pending{
+		msg: &Message{
+			Topic:   topic,
+			Payload: payload,
+		},
+		future: f,
+	}
+
+	return f
+}
+
+// Flush sends the messages queued and waits for them to be published
+func (p *Producer) Flush(ctx context.Context) error {
+	ch := make(chan bool)
+
+	p.RLock()
+	if p.closed {
+		p.RUnlock()
+		return errors.New("producer closed")
+	}
+	select {
+	case p.queue <- &pending{flush: ch}:
+	case <-ctx.Done():
+		p.RUnlock()
+		return ctx.Err()
+	}
+	p.RUnlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close flushes the messages queued and stops the producer.
+// The client is not closed.
+func (p *Producer) Close() error {
+	p.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.Unlock()
+
+	<-p.done
+	return nil
+}
+
+// NewProducer returns a producer publishing batches with the client
+func NewProducer(c Client, opts ...ProducerOption) *Producer {
+	options := ProducerOptions{
+		BatchSize:      100,
+		BatchBytes:     1024 * 1024,
+		FlushInterval:  time.Millisecond * 10,
+		BufferSize:     10000,
+		PublishTimeout: time.Second * 30,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = 1
+	}
+
+	if options.BufferSize < 0 {
+		options.BufferSize = 0
+	}
+
+	p := &Producer{
+		client:  c,
+		options: options,
+		queue:   make(chan *pending, options.BufferSize),
+		done:    make(chan bool),
+	}
+
+	go p.run()
+
+	return p
+}
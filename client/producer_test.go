@@ -0,0 +1,209 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClient records the messages published
+type testClient struct {
+	sync.Mutex
+	published []*Message
+	// blocks publishing until closed
+	block chan bool
+}
+
+// batchClient records the batches published
+type batchClient struct {
+	testClient
+	batches [][]*Message
+}
+
+func (c *testClient) wait(ctx context.Context) error {
+	if c.block == nil {
+		return nil
+	}
+	select {
+	case <-c.block:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *testClient) Close() error {
+	return nil
+}
+
+func (c *testClient) Publish(topic string, payload []byte) error {
+	if err := c.wait(context.Background()); err != nil {
+		return err
+	}
+	c.Lock()
+	c.published = append(c.published, &Message{Topic: topic, Payload: payload})
+	c.Unlock()
+	return nil
+}
+
+func (c *testClient) Subscribe(topic string) (<-chan []byte, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *testClient) Unsubscribe(<-chan []byte) error {
+	return nil
+}
+
+func (c *batchClient) PublishBatch(ctx context.Context, msgs []*Message) []error {
+	errs := make([]error, len(msgs))
+	if err := c.wait(ctx); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	c.Lock()
+	c.batches = append(c.batches, msgs)
+	c.Unlock()
+	return errs
+}
+
+func TestProducerFlush(t *testing.T) {
+	testCases := []struct {
+		name     string
+		opts     []ProducerOption
+		payloads []string
+		// sizes of the batches sent
+		batches []int
+		// min time before the batch is sent
+		wait time.Duration
+	}{
+		{
+			name:     "size",
+			opts:     []ProducerOption{BatchSize(2), FlushInterval(time.Hour)},
+			payloads: []string{"a", "b", "c", "d"},
+			batches:  []int{2, 2},
+		},
+		{
+			name:     "bytes",
+			opts:     []ProducerOption{BatchSize(100), BatchBytes(4), FlushInterval(time.Hour)},
+			payloads: []string{"aa", "bb", "cc", "dd"},
+			batches:  []int{2, 2},
+		},
+		{
+			name:     "interval",
+			opts:     []ProducerOption{BatchSize(100), FlushInterval(time.Millisecond * 20)},
+			payloads: []string{"a", "b", "c"},
+			batches:  []int{3},
+			wait:     time.Millisecond * 20,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := new(batchClient)
+			p := NewProducer(c, tc.opts...)
+			defer p.Close()
+
+			start := time.Now()
+
+			var futures []*Future
+			for _, b := range tc.payloads {
+				futures = append(futures, p.Publish("foo", []byte(b)))
+			}
+
+			for _, f := range futures {
+				select {
+				case <-f.Done():
+				case <-time.After(time.Second):
+					t.Fatal("timed out waiting for the batch to be sent")
+				}
+				if err := f.Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if d := time.Since(start); d < tc.wait {
+				t.Fatalf("expected batch sent after %v got %v", tc.wait, d)
+			}
+
+			c.Lock()
+			defer c.Unlock()
+
+			if len(c.batches) != len(tc.batches) {
+				t.Fatalf("expected %d batches got %d", len(tc.batches), len(c.batches))
+			}
+			for i, n := range tc.batches {
+				if len(c.batches[i]) != n {
+					t.Fatalf("expected batch %d of %d messages got %d", i, n, len(c.batches[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestProducerTimeout(t *testing.T) {
+	c := &batchClient{testClient: testClient{block: make(chan bool)}}
+	p := NewProducer(c, BatchSize(1), PublishTimeout(time.Millisecond*20))
+	defer p.Close()
+
+	if err := p.Publish("foo", []byte("bar")).Wait(); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded got %v", err)
+	}
+}
+
+func TestProducerFlushContext(t *testing.T) {
+	c := &batchClient{testClient: testClient{block: make(chan bool)}}
+	p := NewProducer(c, BatchSize(1), PublishTimeout(0))
+	defer p.Close()
+
+	f := p.Publish("foo", []byte("bar"))
+
+	// the batch is blocked sending
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	if err := p.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	if err := p.Flush(ctx); err != context.Canceled {
+		t.Fatalf("expected canceled got %v", err)
+	}
+
+	close(c.block)
+
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProducerFallback(t *testing.T) {
+	c := new(testClient)
+	p := NewProducer(c, BatchSize(2))
+
+	a := p.Publish("foo", []byte("a"))
+	b := p.Publish("foo", []byte("b"))
+
+	p.Close()
+
+	if err := a.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// published one at a time without batches
+	if len(c.published) != 2 {
+		t.Fatalf("expected 2 messages published got %d", len(c.published))
+	}
+}
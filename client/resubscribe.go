@@ -0,0 +1,96 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// State of a subscription to a server
+type State int
+
+const (
+	// Connected is reported when resubscribed to the server
+	Connected State = iota
+	// Disconnected is reported when the subscription drops
+	Disconnected
+	// Reconnecting is reported before each attempt to resubscribe
+	Reconnecting
+)
+
+// Event is a change of the state of a subscription to a server
+type Event struct {
+	Topic  string
+	Server string
+	State  State
+	// Attempt to resubscribe
+	Attempt int
+	// Error dropping the subscription or of the last attempt
+	Error error
+}
+
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	case Reconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// Backoff returns the exponential backoff with jitter before
+// the attempt, doubling from min up to max
+func Backoff(attempt int, min, max time.Duration) time.Duration {
+	d := min
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	// wait at least half the backoff
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Resubscribe reports the dropped subscription and calls subscribe with
+// backoff until it succeeds. Returns false if exit is closed first or
+// resubscribing is disabled.
+func Resubscribe(options Options, topic, server string, err error, exit <-chan bool, subscribe func() error) bool {
+	notify := func(e Event) {
+		if options.StateChange != nil {
+			options.StateChange(e)
+		}
+	}
+
+	options.Logger.Warn("Subscription closed", "server", server, "topic", topic, "error", err)
+	notify(Event{Topic: topic, Server: server, State: Disconnected, Error: err})
+
+	if !options.Resubscribe {
+		return false
+	}
+
+	for attempt := 1; ; attempt++ {
+		t := time.NewTimer(Backoff(attempt, options.MinBackoff, options.MaxBackoff))
+		select {
+		case <-exit:
+			t.Stop()
+			return false
+		case <-t.C:
+		}
+
+		notify(Event{Topic: topic, Server: server, State: Reconnecting, Attempt: attempt, Error: err})
+
+		if err = subscribe(); err == nil {
+			options.Logger.Info("Resubscribed", "server", server, "topic", topic, "attempt", attempt)
+			notify(Event{Topic: topic, Server: server, State: Connected, Attempt: attempt})
+			return true
+		}
+
+		options.Logger.Warn("Resubscribe failed", "server", server, "topic", topic, "attempt", attempt, "error", err)
+	}
+}
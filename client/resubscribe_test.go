@@ -0,0 +1,42 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	testCases := []struct {
+		name     string
+		attempt  int
+		min, max time.Duration
+		// expected range of the backoff with jitter
+		lower, upper time.Duration
+	}{
+		{"first", 1, time.Millisecond * 100, time.Second, time.Millisecond * 50, time.Millisecond * 100},
+		{"doubled", 3, time.Millisecond * 100, time.Second, time.Millisecond * 200, time.Millisecond * 400},
+		{"capped", 10, time.Millisecond * 100, time.Second, time.Millisecond * 500, time.Second},
+		{"min over max", 1, time.Second * 2, time.Second, time.Millisecond * 500, time.Second},
+		{"zero attempt", 0, time.Millisecond * 100, time.Second, time.Millisecond * 50, time.Millisecond * 100},
+		{"disabled", 5, 0, 0, 0, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+
+			for i := 0; i < 100; i++ {
+				d := Backoff(tc.attempt, tc.min, tc.max)
+				if d < tc.lower || d > tc.upper {
+					t.Fatalf("expected backoff between %v and %v got %v", tc.lower, tc.upper, d)
+				}
+				seen[d] = true
+			}
+
+			// jittered unless disabled
+			if tc.upper > 0 && len(seen) < 2 {
+				t.Fatalf("expected jitter got %v", seen)
+			}
+		})
+	}
+}
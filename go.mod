@@ -3,7 +3,6 @@ module github.com/asim/emque
 go 1.18
 
 require (
-	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/websocket v1.4.2
 	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
 	google.golang.org/grpc v1.40.0
@@ -11,7 +10,6 @@ require (
 )
 
 require (
-	github.com/felixge/httpsnoop v1.0.1 // indirect
 	github.com/golang/protobuf v1.4.3 // indirect
 	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f // indirect
 	golang.org/x/text v0.3.3 // indirect
@@ -0,0 +1,268 @@
+// Package logger is a levelled structured logger
+// writing JSON or logfmt key value pairs.
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level of a log event
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+// Format of the log output
+type Format string
+
+const (
+	JSON   Format = "json"
+	Logfmt Format = "logfmt"
+)
+
+var (
+	// Default logger writes logfmt to stderr at info level
+	Default = New()
+)
+
+// Logger logs messages with key value pairs of fields
+type Logger interface {
+	Log(level Level, msg string, fields ...interface{})
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+	// With returns a logger which includes the fields in every event
+	With(fields ...interface{}) Logger
+}
+
+type contextKey struct{}
+
+// internal logger
+type logger struct {
+	options Options
+	fields  []interface{}
+	// shared by loggers created via With
+	mtx *sync.Mutex
+}
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %s", s)
+}
+
+// ParseFormat parses json or logfmt
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case JSON, Logfmt:
+		return f, nil
+	}
+	return Logfmt, fmt.Errorf("unknown log format %s", s)
+}
+
+// value returns a value which can be encoded
+func value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
+
+func (l *logger) json(buf *bytes.Buffer, level Level, msg string, fields []interface{}) {
+	buf.WriteString(`{"time":`)
+	b, _ := json.Marshal(time.Now().Format(time.RFC3339Nano))
+	buf.Write(b)
+	buf.WriteString(`,"level":"` + level.String() + `","msg":`)
+	b, _ = json.Marshal(msg)
+	buf.Write(b)
+
+	for i := 0; i < len(fields); i += 2 {
+		k, _ := json.Marshal(fmt.Sprint(fields[i]))
+		var v interface{}
+		if i+1 < len(fields) {
+			v = value(fields[i+1])
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprint(v))
+		}
+		buf.WriteByte(',')
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(b)
+	}
+
+	buf.WriteString("}\n")
+}
+
+// quote quotes logfmt values containing spaces, quotes or equals signs
+func quote(s string) string {
+	if len(s) == 0 || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (l *logger) logfmt(buf *bytes.Buffer, level Level, msg string, fields []interface{}) {
+	buf.WriteString("time=" + time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(" level=" + level.String())
+	buf.WriteString(" msg=" + quote(msg))
+
+	for i := 0; i < len(fields); i += 2 {
+		var v interface{}
+		if i+1 < len(fields) {
+			v = value(fields[i+1])
+		}
+		buf.WriteString(" " + quote(fmt.Sprint(fields[i])) + "=" + quote(fmt.Sprint(v)))
+	}
+
+	buf.WriteByte('\n')
+}
+
+func (l *logger) Log(level Level, msg string, fields ...interface{}) {
+	if level < l.options.Level {
+		return
+	}
+
+	all := make([]interface{}, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+
+	buf := bytes.NewBuffer(nil)
+	if l.options.Format == JSON {
+		l.json(buf, level, msg, all)
+	} else {
+		l.logfmt(buf, level, msg, all)
+	}
+
+	l.mtx.Lock()
+	l.options.Output.Write(buf.Bytes())
+	l.mtx.Unlock()
+}
+
+func (l *logger) Debug(msg string, fields ...interface{}) {
+	l.Log(DebugLevel, msg, fields...)
+}
+
+func (l *logger) Info(msg string, fields ...interface{}) {
+	l.Log(InfoLevel, msg, fields...)
+}
+
+func (l *logger) Warn(msg string, fields ...interface{}) {
+	l.Log(WarnLevel, msg, fields...)
+}
+
+func (l *logger) Error(msg string, fields ...interface{}) {
+	l.Log(ErrorLevel, msg, fields...)
+}
+
+func (l *logger) With(fields ...interface{}) Logger {
+	f := make([]interface{}, 0, len(l.fields)+len(fields))
+	f = append(f, l.fields...)
+	f = append(f, fields...)
+
+	return &logger{
+		options: l.options,
+		fields:  f,
+		mtx:     l.mtx,
+	}
+}
+
+// NewContext returns a context carrying the logger
+func NewContext(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by the context or the Default
+func FromContext(ctx context.Context) Logger {
+	if l, ok := ctx.Value(contextKey{}).(Logger); ok {
+		return l
+	}
+	return Default
+}
+
+// New returns a Logger
+func New(opts ...Option) Logger {
+	options := Options{
+		Level:  InfoLevel,
+		Format: Logfmt,
+		Output: os.Stderr,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	return &logger{
+		options: options,
+		fields:  options.Fields,
+		mtx:     new(sync.Mutex),
+	}
+}
+
+// Debug logs via the Default logger
+func Debug(msg string, fields ...interface{}) {
+	Default.Debug(msg, fields...)
+}
+
+// Info logs via the Default logger
+func Info(msg string, fields ...interface{}) {
+	Default.Info(msg, fields...)
+}
+
+// Warn logs via the Default logger
+func Warn(msg string, fields ...interface{}) {
+	Default.Warn(msg, fields...)
+}
+
+// Error logs via the Default logger
+func Error(msg string, fields ...interface{}) {
+	Default.Error(msg, fields...)
+}
+
+// Fatal logs via the Default logger and exits
+func Fatal(msg string, fields ...interface{}) {
+	Default.Error(msg, fields...)
+	os.Exit(1)
+}
@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogfmt(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	l := New(WithOutput(buf), WithLevel(InfoLevel), WithFields("service", "emque"))
+
+	l.Debug("not logged")
+	l.With("topic", "foo").Warn("message dropped", "subscriber", "a b", "error", errors.New("slow"))
+
+	out := buf.String()
+	if strings.Contains(out, "not logged") {
+		t.Fatal("expected debug to be filtered")
+	}
+	for _, s := range []string{
+		"level=warn",
+		`msg="message dropped"`,
+		"service=emque",
+		"topic=foo",
+		`subscriber="a b"`,
+		"error=slow",
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("expected %s in %s", s, out)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	l := New(WithOutput(buf), WithFormat(JSON), WithLevel(DebugLevel))
+
+	ctx := NewContext(context.Background(), l.With("request_id", "1"))
+	FromContext(ctx).Debug("request", "code", 200)
+
+	var ev map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev["level"] != "debug" || ev["msg"] != "request" || ev["request_id"] != "1" || ev["code"] != float64(200) {
+		t.Fatalf("unexpected event %v", ev)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, l := range map[string]Level{
+		"debug": DebugLevel,
+		"INFO":  InfoLevel,
+		"warn":  WarnLevel,
+		"error": ErrorLevel,
+	} {
+		v, err := ParseLevel(s)
+		if err != nil || v != l {
+			t.Fatalf("expected %s got %s %v", l, v, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("expected error")
+	}
+}
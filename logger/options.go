@@ -0,0 +1,46 @@
+package logger
+
+import (
+	"io"
+)
+
+type Options struct {
+	// Minimum level logged
+	Level Level
+	// Output format, logfmt by default
+	Format Format
+	// Output written to, stderr by default
+	Output io.Writer
+	// Fields included in every event
+	Fields []interface{}
+}
+
+type Option func(o *Options)
+
+// WithLevel sets the minimum level logged
+func WithLevel(l Level) Option {
+	return func(o *Options) {
+		o.Level = l
+	}
+}
+
+// WithFormat sets the output format
+func WithFormat(f Format) Option {
+	return func(o *Options) {
+		o.Format = f
+	}
+}
+
+// WithOutput sets the writer logs are written to
+func WithOutput(w io.Writer) Option {
+	return func(o *Options) {
+		o.Output = w
+	}
+}
+
+// WithFields sets key value pairs included in every event
+func WithFields(fields ...interface{}) Option {
+	return func(o *Options) {
+		o.Fields = fields
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/asim/emque/broker"
@@ -15,18 +18,41 @@ import (
 	mqgrpc "github.com/asim/emque/client/grpc"
 	mqresolver "github.com/asim/emque/client/resolver"
 	mqselector "github.com/asim/emque/client/selector"
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/namespace"
 	"github.com/asim/emque/server"
 	grpcsrv "github.com/asim/emque/server/grpc"
 	httpsrv "github.com/asim/emque/server/http"
+	muxsrv "github.com/asim/emque/server/mux"
+	"google.golang.org/grpc/keepalive"
 )
 
 var (
-	address = flag.String("address", ":8081", "MQ server address")
+	address = flag.String("address", ":8081", "MQ server address. Use unix:///path for a unix domain socket")
 	cert    = flag.String("cert_file", "", "TLS certificate file")
 	key     = flag.String("key_file", "", "TLS key file")
+	certDir = flag.String("cert_dir", "", "Directory to persist a generated CA and certificate")
+
+	// request limits
+	maxBodySize = flag.Int64("max_body_size", 4<<20, "Max size in bytes of messages and batches published over HTTP")
+
+	// plaintext
+	insecure = flag.Bool("insecure", false, "Serve and connect to servers in plaintext rather than TLS")
+
+	// client certificate verification
+	clientCA   = flag.String("client_ca_file", "", "CA file used by the server to verify client certificates")
+	clientAuth = flag.Bool("client_auth", false, "Require client certificates signed by the client CA")
 
 	// server persist to file
 	persist = flag.Bool("persist", false, "Persist messages to [topic].mq file per topic")
+	dataDir = flag.String("data_dir", "", "Directory persisted topics are stored in. Defaults to the working directory")
+
+	// admin API
+	admins = flag.String("admins", "", "Comma separated client certificate common names allowed to use the admin API. Use * to allow anyone")
+
+	// multi-tenant namespaces
+	namespaces      = flag.Bool("namespaces", false, "Serve namespaces selected by the /ns/{name}/ path, X-Emque-Namespace header or client certificate. Stored in [data_dir]/namespaces")
+	namespaceAdmins = flag.String("namespace_admins", "", "Comma separated client certificate common names allowed to manage namespaces. Use * to allow anyone")
 
 	// proxy flags
 	proxy   = flag.Bool("proxy", false, "Proxy for an MQ cluster")
@@ -39,32 +65,69 @@ var (
 	publish     = flag.Bool("publish", false, "Publish via the MQ client")
 	subscribe   = flag.Bool("subscribe", false, "Subscribe via the MQ client")
 	topic       = flag.String("topic", "", "Topic for client to publish or subscribe to")
+	ns          = flag.String("namespace", "", "Namespace for client to publish or subscribe in")
+
+	// client tls flags
+	ca         = flag.String("ca_file", "", "CA file used by the client to verify servers")
+	clientCert = flag.String("client_cert_file", "", "TLS certificate file used by the client")
+	clientKey  = flag.String("client_key_file", "", "TLS key file used by the client")
+	serverName = flag.String("server_name", "", "Server name used by the client to verify servers")
+	skipVerify = flag.Bool("skip_verify", false, "Skip verification of server certificates by the client even if a CA is specified")
 
 	// select strategy
 	selector = flag.String("select", "all", "Server select strategy. Supports all, shard")
 	// resolver for discovery
 	resolver = flag.String("resolver", "ip", "Server resolver for discovery. Supports ip, dns")
 	// transport http or grpc
-	transport = flag.String("transport", "http", "Transport for communication. Support http, grpc")
+	transport = flag.String("transport", "http", "Transport for communication. Support http, grpc, all")
+	// serve grpc on a separate address with transport all
+	grpcAddress = flag.String("grpc_address", "", "GRPC server address for transport all. Defaults to sharing the MQ server address")
+	// grpc server configuration
+	grpcReflection   = flag.Bool("grpc_reflection", false, "Register the GRPC reflection service for tools like grpcurl")
+	grpcMaxStreams   = flag.Uint("grpc_max_streams", 0, "Max concurrent GRPC streams per connection. Defaults to unlimited")
+	grpcKeepalive    = flag.Duration("grpc_keepalive", 0, "Interval the GRPC server pings idle connections. Defaults to 2h")
+	grpcKeepaliveMin = flag.Duration("grpc_keepalive_min_time", 0, "Minimum interval allowed between GRPC client pings. Defaults to 5m")
+
+	// time allowed for subscribers to drain on shutdown
+	shutdownTimeout = flag.Duration("shutdown_timeout", time.Second*30, "Time to drain subscribers and complete requests on shutdown")
+
+	// logging
+	logLevel  = flag.String("log_level", "info", "Log level. Supports debug, info, warn, error")
+	logFormat = flag.String("log_format", "logfmt", "Log format. Supports logfmt, json")
 )
 
 func init() {
 	flag.Parse()
 
+	level, err := logger.ParseLevel(*logLevel)
+	if err != nil {
+		logger.Fatal("Invalid log level", "error", err)
+	}
+
+	format, err := logger.ParseFormat(*logFormat)
+	if err != nil {
+		logger.Fatal("Invalid log format", "error", err)
+	}
+
+	logger.Default = logger.New(
+		logger.WithLevel(level),
+		logger.WithFormat(format),
+	)
+
 	if *proxy && *client {
-		log.Fatal("Client and proxy flags cannot be specified together")
+		logger.Fatal("Client and proxy flags cannot be specified together")
 	}
 
 	if *proxy && len(*servers) == 0 {
-		log.Fatal("Proxy enabled without MQ server list")
+		logger.Fatal("Proxy enabled without MQ server list")
 	}
 
 	if *client && len(*topic) == 0 {
-		log.Fatal("Topic not specified")
+		logger.Fatal("Topic not specified")
 	}
 
 	if *client && !*publish && !*subscribe {
-		log.Fatal("Specify whether to publish or subscribe")
+		logger.Fatal("Specify whether to publish or subscribe")
 	}
 
 	if (*client || *interactive) && len(*servers) == 0 {
@@ -93,6 +156,27 @@ func init() {
 		mqclient.WithSelector(selecter),
 		mqclient.WithServers(strings.Split(*servers, ",")...),
 		mqclient.WithRetries(*retries),
+		mqclient.WithInsecure(*insecure),
+	}
+
+	if len(*ca) > 0 {
+		options = append(options, mqclient.WithCA(*ca))
+	}
+
+	if len(*clientCert) > 0 && len(*clientKey) > 0 {
+		options = append(options, mqclient.WithCertificate(*clientCert, *clientKey))
+	}
+
+	if len(*serverName) > 0 {
+		options = append(options, mqclient.WithServerName(*serverName))
+	}
+
+	if len(*ns) > 0 {
+		options = append(options, mqclient.WithNamespace(*ns))
+	}
+
+	if *skipVerify {
+		options = append(options, mqclient.WithInsecureSkipVerify(true))
 	}
 
 	switch *transport {
@@ -105,6 +189,7 @@ func init() {
 	broker.Default = broker.New(
 		broker.Client(bclient),
 		broker.Persist(*persist),
+		broker.Dir(*dataDir),
 		broker.Proxy(*client || *proxy || *interactive),
 	)
 }
@@ -163,8 +248,6 @@ func cli() {
 			d = map[string]time.Time{}
 		}
 	}
-
-	wg.Wait()
 }
 
 func main() {
@@ -174,38 +257,180 @@ func main() {
 		return
 	}
 
-	// cleanup broker
-	defer broker.Default.Close()
-
 	options := []server.Option{
 		server.WithAddress(*address),
+		server.WithInsecure(*insecure),
+		server.WithBroker(broker.Default),
+		server.WithMaxBodySize(*maxBodySize),
+	}
+
+	// webhooks are saved with the persisted topics
+	if len(*dataDir) > 0 {
+		options = append(options, server.WithDataDir(*dataDir))
+	} else {
+		options = append(options, server.WithDataDir("."))
+	}
+
+	// admin API enabled
+	if len(*admins) > 0 {
+		logger.Info("Admin API enabled", "admins", *admins)
+		options = append(options, server.WithAdmins(strings.Split(*admins, ",")...))
 	}
 
 	// proxy enabled
 	if *proxy {
-		log.Println("Proxy enabled")
+		logger.Info("Proxy enabled", "servers", *servers)
 	}
 
 	// tls enabled
-	if len(*cert) > 0 && len(*key) > 0 {
-		log.Println("TLS Enabled")
+	if *insecure {
+		logger.Info("Plaintext enabled")
+	} else if len(*cert) > 0 && len(*key) > 0 {
+		logger.Info("TLS enabled")
 		options = append(options, server.WithTLS(*cert, *key))
+	} else if len(*certDir) > 0 {
+		logger.Info("Using CA", "cert_dir", *certDir)
+		options = append(options, server.WithCertDir(*certDir))
+	}
+
+	// client certificate verification
+	if len(*clientCA) > 0 {
+		logger.Info("Client certificate verification enabled", "require", *clientAuth)
+		options = append(options, server.WithClientAuth(*clientCA, *clientAuth))
 	}
 
-	var server server.Server
+	// namespaces enabled
+	var manager *namespace.Manager
+	if *namespaces {
+		if *proxy {
+			logger.Fatal("Namespaces are not supported by the proxy")
+		}
+		nopts := []namespace.Option{
+			namespace.Broker(broker.Default),
+			namespace.Dir(filepath.Join(*dataDir, "namespaces")),
+		}
+		if len(*namespaceAdmins) > 0 {
+			nopts = append(nopts, namespace.Admins(strings.Split(*namespaceAdmins, ",")...))
+		}
+		var err error
+		manager, err = namespace.New(nopts...)
+		if err != nil {
+			logger.Fatal("Failed to load namespaces", "error", err)
+		}
+		logger.Info("Namespaces enabled", "namespaces", len(manager.List()))
+		options = append(options, server.WithNamespaces(manager))
+	}
+
+	// grpc server configuration
+	if *grpcReflection {
+		options = append(options, server.WithReflection(true))
+	}
+	if *grpcMaxStreams > 0 {
+		options = append(options, server.WithMaxConcurrentStreams(uint32(*grpcMaxStreams)))
+	}
+	if *grpcKeepalive > 0 {
+		options = append(options, server.WithKeepalive(keepalive.ServerParameters{
+			Time: *grpcKeepalive,
+		}))
+	}
+	if *grpcKeepaliveMin > 0 {
+		options = append(options, server.WithKeepalivePolicy(keepalive.EnforcementPolicy{
+			MinTime:             *grpcKeepaliveMin,
+			PermitWithoutStream: true,
+		}))
+	}
+
+	var servers []server.Server
 
 	// now serve the transport
 	switch *transport {
 	case "grpc":
-		log.Println("GRPC transport enabled")
-		server = grpcsrv.New(options...)
+		logger.Info("GRPC transport enabled")
+		servers = append(servers, grpcsrv.New(options...))
+	case "all":
+		if len(*grpcAddress) > 0 {
+			logger.Info("HTTP and GRPC transports enabled", "grpc_address", *grpcAddress)
+			grpcOptions := append([]server.Option{}, options...)
+			grpcOptions = append(grpcOptions, server.WithAddress(*grpcAddress))
+			servers = append(servers, httpsrv.New(options...), grpcsrv.New(grpcOptions...))
+		} else {
+			logger.Info("HTTP and GRPC transports enabled on the same address")
+			servers = append(servers, muxsrv.New(options...))
+		}
 	default:
-		log.Println("HTTP transport enabled")
-		server = httpsrv.New(options...)
+		logger.Info("HTTP transport enabled")
+		servers = append(servers, httpsrv.New(options...))
+	}
+
+	logger.Info("MQ listening", "address", *address)
+
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv server.Server) {
+			errCh <- srv.Run()
+		}(srv)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errCh:
+		logger.Error("Server failed", "error", err)
+		shutdown(servers, manager)
+		os.Exit(1)
+	case s := <-sig:
+		logger.Info("Shutting down", "signal", s)
+		shutdown(servers, manager)
+	}
+}
+
+// shutdown stops accepting connections, drains subscribers
+// and flushes persisted messages within the shutdown timeout
+func shutdown(servers []server.Server, manager *namespace.Manager) {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	// stop accepting connections
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv server.Server) {
+			defer wg.Done()
+			if err := srv.Stop(); err != nil {
+				logger.Error("Failed to stop server", "error", err)
+			}
+		}(srv)
 	}
 
-	log.Println("MQ listening on", *address)
-	if err := server.Run(); err != nil {
-		log.Fatal(err)
+	// drain subscribers which ends their requests
+	var drain sync.WaitGroup
+	if manager != nil {
+		drain.Add(1)
+		go func() {
+			defer drain.Done()
+			if err := manager.Shutdown(ctx); err != nil {
+				logger.Error("Failed to shutdown namespaces", "error", err)
+			}
+		}()
+	}
+
+	if err := broker.Default.Shutdown(ctx); err != nil {
+		logger.Error("Failed to shutdown broker", "error", err)
+	}
+	drain.Wait()
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		logger.Info("Shutdown complete")
+	case <-ctx.Done():
+		logger.Warn("Timed out waiting for requests to complete")
 	}
 }
@@ -0,0 +1,389 @@
+// Package metrics is a minimal registry of counters, gauges and
+// histograms exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	Default = NewRegistry()
+
+	// DefaultBuckets are latency buckets in seconds
+	DefaultBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+)
+
+// Registry holds a set of metrics
+type Registry struct {
+	sync.RWMutex
+	metrics map[string]*metric
+}
+
+// Counter is a value which only increases
+type Counter struct {
+	m *metric
+}
+
+// Gauge is a value which can go up and down
+type Gauge struct {
+	m *metric
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	m *metric
+}
+
+// internal metric
+type metric struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	sync.RWMutex
+	series map[string]*series
+}
+
+// internal series of a metric with label values
+type series struct {
+	values []string
+
+	sync.Mutex
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// series returns the series for the label values creating it if necessary
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values got %d", m.name, len(m.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	m.RLock()
+	s, ok := m.series[key]
+	m.RUnlock()
+	if ok {
+		return s
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if s, ok := m.series[key]; ok {
+		return s
+	}
+
+	s = &series{
+		values: append([]string(nil), values...),
+		counts: make([]uint64, len(m.buckets)),
+	}
+	m.series[key] = s
+	return s
+}
+
+// delete removes the series for the label values
+func (m *metric) delete(values []string) {
+	m.Lock()
+	delete(m.series, strings.Join(values, "\xff"))
+	m.Unlock()
+}
+
+// write writes the series, only those with the label value if a label is set
+func (m *metric) write(w io.Writer, label, value string) error {
+	idx := -1
+	for i, l := range m.labels {
+		if l == label {
+			idx = i
+		}
+	}
+	if len(label) > 0 && idx < 0 {
+		return nil
+	}
+
+	m.RLock()
+	list := make([]*series, 0, len(m.series))
+	for _, s := range m.series {
+		if idx >= 0 && s.values[idx] != value {
+			continue
+		}
+		list = append(list, s)
+	}
+	m.RUnlock()
+
+	if len(list) == 0 {
+		return nil
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].values, "\xff") < strings.Join(list[j].values, "\xff")
+	})
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, escape(m.help, false), m.name, m.typ); err != nil {
+		return err
+	}
+
+	for _, s := range list {
+		s.Lock()
+		var err error
+		if m.typ == "histogram" {
+			var cum uint64
+			for i, b := range m.buckets {
+				cum += s.counts[i]
+				le := labels(m.labels, s.values, "le", format(b))
+				if _, err = fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, le, cum); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				l := labels(m.labels, s.values)
+				_, err = fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+					m.name, labels(m.labels, s.values, "le", "+Inf"), s.count,
+					m.name, l, format(s.sum),
+					m.name, l, s.count)
+			}
+		} else {
+			_, err = fmt.Fprintf(w, "%s%s %s\n", m.name, labels(m.labels, s.values), format(s.value))
+		}
+		s.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// labels formats label pairs e.g {topic="foo"}
+func labels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escape(values[i], true)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1], true)+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func format(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *metric {
+	r.Lock()
+	defer r.Unlock()
+
+	if m, ok := r.metrics[name]; ok {
+		if m.typ != typ {
+			panic("metrics: " + name + " already registered as " + m.typ)
+		}
+		return m
+	}
+
+	m := &metric{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// Counter registers a counter. Registering the same name returns the existing counter.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+// Gauge registers a gauge. Registering the same name returns the existing gauge.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", nil, labels)}
+}
+
+// Histogram registers a histogram with the upper bounds of the buckets.
+// DefaultBuckets are used if none are specified.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+// Write writes all metrics in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	return r.write(w, "", "")
+}
+
+// WriteLabel writes the series with the label value e.g a namespace.
+// Metrics without the label are not written.
+func (r *Registry) WriteLabel(w io.Writer, label, value string) error {
+	return r.write(w, label, value)
+}
+
+func (r *Registry) write(w io.Writer, label, value string) error {
+	r.RLock()
+	list := make([]*metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		list = append(list, m)
+	}
+	r.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+
+	for _, m := range list {
+		if err := m.write(w, label, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// LabelHandler serves the series with the label value
+func (r *Registry) LabelHandler(label, value string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteLabel(w, label, value)
+	})
+}
+
+// Add increases the counter by v which must not be negative
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	s := c.m.get(values)
+	s.Lock()
+	s.value += v
+	s.Unlock()
+}
+
+// Inc increments the counter by 1
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Delete removes the series for the label values
+func (c *Counter) Delete(values ...string) {
+	c.m.delete(values)
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64, values ...string) {
+	s := g.m.get(values)
+	s.Lock()
+	s.value = v
+	s.Unlock()
+}
+
+// Add adds v to the gauge
+func (g *Gauge) Add(v float64, values ...string) {
+	s := g.m.get(values)
+	s.Lock()
+	s.value += v
+	s.Unlock()
+}
+
+// Delete removes the series for the label values
+func (g *Gauge) Delete(values ...string) {
+	g.m.delete(values)
+}
+
+// Observe records the value in the histogram
+func (h *Histogram) Observe(v float64, values ...string) {
+	s := h.m.get(values)
+	s.Lock()
+	for i, b := range h.m.buckets {
+		if v <= b {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+	s.Unlock()
+}
+
+// Delete removes the series for the label values
+func (h *Histogram) Delete(values ...string) {
+	h.m.delete(values)
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*metric),
+	}
+}
+
+// NewCounter registers a counter with the default registry
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.Counter(name, help, labels...)
+}
+
+// NewGauge registers a gauge with the default registry
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.Gauge(name, help, labels...)
+}
+
+// NewHistogram registers a histogram with the default registry
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.Histogram(name, help, buckets, labels...)
+}
+
+// Handler serves the default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// LabelHandler serves the series of the default registry with the label value
+func LabelHandler(label, value string) http.Handler {
+	return Default.LabelHandler(label, value)
+}
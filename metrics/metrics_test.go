@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.Counter("test_total", "A counter.", "topic")
+	c.Inc("foo")
+	c.Add(2, "foo")
+	c.Inc(`b"ar`)
+
+	g := r.Gauge("test_gauge", "A gauge.")
+	g.Set(5)
+	g.Add(-2)
+
+	h := r.Histogram("test_seconds", "A histogram.", []float64{1, 0.1}, "topic")
+	h.Observe(0.05, "foo")
+	h.Observe(0.5, "foo")
+	h.Observe(5, "foo")
+
+	// no series are not written
+	r.Counter("test_empty_total", "Empty.")
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 3
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{topic="foo",le="0.1"} 1
+test_seconds_bucket{topic="foo",le="1"} 2
+test_seconds_bucket{topic="foo",le="+Inf"} 3
+test_seconds_sum{topic="foo"} 5.55
+test_seconds_count{topic="foo"} 3
+# HELP test_total A counter.
+# TYPE test_total counter
+test_total{topic="b\"ar"} 1
+test_total{topic="foo"} 3
+`
+
+	if buf.String() != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+
+	// only series with the label value are written
+	buf.Reset()
+	if err := r.WriteLabel(&buf, "topic", "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = `# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{topic="foo",le="0.1"} 1
+test_seconds_bucket{topic="foo",le="1"} 2
+test_seconds_bucket{topic="foo",le="+Inf"} 3
+test_seconds_sum{topic="foo"} 5.55
+test_seconds_count{topic="foo"} 3
+# HELP test_total A counter.
+# TYPE test_total counter
+test_total{topic="foo"} 3
+`
+
+	if buf.String() != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+
+	c.Delete("foo")
+	if c.m.series["foo"] != nil {
+		t.Fatal("expected series to be deleted")
+	}
+}
@@ -0,0 +1,442 @@
+// Package namespace isolates the topics of different tenants
+// in namespaces each served by their own broker.
+package namespace
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/metrics"
+	"github.com/asim/emque/trace"
+)
+
+const (
+	// DefaultName is the namespace used when none is selected
+	DefaultName = "default"
+	// Header selecting the namespace of a request
+	Header = "X-Emque-Namespace"
+)
+
+var (
+	ErrNotFound      = errors.New("namespace not found")
+	ErrForbidden     = errors.New("forbidden")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	rejected = metrics.NewCounter("emque_namespace_rejected_total", "Requests rejected by namespace quotas and ACLs.", "namespace", "reason")
+
+	// names are used as directories and paths
+	validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+)
+
+// Action is checked against the namespace ACL
+type Action string
+
+const (
+	Publish   Action = "publish"
+	Subscribe Action = "subscribe"
+	Admin     Action = "admin"
+)
+
+// Namespace is an isolated set of topics
+type Namespace struct {
+	Name string `json:"name"`
+	// Persist topics to the namespace directory
+	Persist bool      `json:"persist"`
+	Quota   *Quota    `json:"quota,omitempty"`
+	ACL     *ACL      `json:"acl,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Quota limits the namespace. Zero values are unlimited.
+type Quota struct {
+	MaxTopics int `json:"max_topics,omitempty"`
+	// Subscribers across all topics
+	MaxSubscribers int `json:"max_subscribers,omitempty"`
+	// Max payload size in bytes
+	MaxMessageSize int `json:"max_message_size,omitempty"`
+	// Messages published per second
+	PublishRate float64 `json:"publish_rate,omitempty"`
+}
+
+// ACL lists the identities allowed each action. Identities are client
+// certificate common names and * allows anyone. An action without
+// identities is allowed for anyone.
+type ACL struct {
+	Publish   []string `json:"publish,omitempty"`
+	Subscribe []string `json:"subscribe,omitempty"`
+	Admin     []string `json:"admin,omitempty"`
+}
+
+// Manager creates namespaces and the brokers serving them
+type Manager struct {
+	options Options
+	// reported as the creation of the default namespace
+	started time.Time
+
+	sync.RWMutex
+	namespaces map[string]*namespace
+}
+
+// internal namespace
+type namespace struct {
+	*Namespace
+	broker broker.Broker
+}
+
+// Identity returns the common name of the verified client certificate
+func Identity(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+func (a *ACL) allowed(action Action) []string {
+	switch action {
+	case Publish:
+		return a.Publish
+	case Subscribe:
+		return a.Subscribe
+	case Admin:
+		return a.Admin
+	}
+	return nil
+}
+
+// Allows returns true if the identity is allowed the action
+func (a *ACL) Allows(identity string, action Action) bool {
+	if a == nil {
+		return true
+	}
+	ids := a.allowed(action)
+	if len(ids) == 0 {
+		return true
+	}
+	for _, id := range ids {
+		if id == "*" || (len(identity) > 0 && id == identity) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) broker() broker.Broker {
+	if m.options.Broker != nil {
+		return m.options.Broker
+	}
+	return broker.Default
+}
+
+// Dir returns the directory the namespace topics are persisted in
+func (m *Manager) Dir(name string) string {
+	return filepath.Join(m.options.Dir, name)
+}
+
+// file returns the file namespace definitions are saved to
+func (m *Manager) file() string {
+	return filepath.Join(m.options.Dir, "namespaces.json")
+}
+
+func (m *Manager) newNamespace(ns *Namespace) *namespace {
+	b := broker.New(
+		broker.Persist(ns.Persist),
+		broker.Dir(m.Dir(ns.Name)),
+		broker.Namespace(ns.Name),
+		broker.Tracer(m.options.Tracer),
+		broker.Logger(m.options.Logger.With("namespace", ns.Name)),
+	)
+
+	return &namespace{
+		Namespace: ns,
+		broker:    newQuota(b, ns),
+	}
+}
+
+// save writes the namespace definitions. Must be called with the manager locked.
+func (m *Manager) save() error {
+	var list []*Namespace
+	for _, ns := range m.namespaces {
+		list = append(list, ns.Namespace)
+	}
+
+	b, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.options.Dir, 0700); err != nil {
+		return err
+	}
+
+	// replace the file atomically
+	tmp := m.file() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.file())
+}
+
+// load creates the saved namespaces
+func (m *Manager) load() error {
+	b, err := ioutil.ReadFile(m.file())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []*Namespace
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, ns := range list {
+		if !validName.MatchString(ns.Name) || ns.Name == DefaultName {
+			continue
+		}
+		m.namespaces[ns.Name] = m.newNamespace(ns)
+	}
+
+	return nil
+}
+
+// Create creates the namespace and starts its broker
+func (m *Manager) Create(ns *Namespace) error {
+	if !validName.MatchString(ns.Name) {
+		return fmt.Errorf("invalid namespace name %q", ns.Name)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.namespaces[ns.Name]; ok || ns.Name == DefaultName {
+		return fmt.Errorf("namespace %s already exists", ns.Name)
+	}
+
+	if ns.Created.IsZero() {
+		ns.Created = time.Now()
+	}
+
+	n := m.newNamespace(ns)
+	m.namespaces[ns.Name] = n
+
+	if err := m.save(); err != nil {
+		delete(m.namespaces, ns.Name)
+		n.broker.Close()
+		return err
+	}
+
+	m.options.Logger.Info("Namespace created", "namespace", ns.Name)
+	return nil
+}
+
+// Delete closes the namespace broker and deletes its persisted topics
+func (m *Manager) Delete(name string) error {
+	if name == DefaultName {
+		return errors.New("default namespace cannot be deleted")
+	}
+
+	m.Lock()
+	ns, ok := m.namespaces[name]
+	delete(m.namespaces, name)
+	var err error
+	if ok {
+		err = m.save()
+	}
+	m.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	ns.broker.Close()
+
+	if rerr := os.RemoveAll(m.Dir(name)); rerr != nil && err == nil {
+		err = rerr
+	}
+
+	m.options.Logger.Info("Namespace deleted", "namespace", name)
+	return err
+}
+
+// Get returns the namespace
+func (m *Manager) Get(name string) (*Namespace, error) {
+	if name == DefaultName {
+		return &Namespace{Name: DefaultName, Created: m.started}, nil
+	}
+
+	m.RLock()
+	ns, ok := m.namespaces[name]
+	m.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	n := *ns.Namespace
+	return &n, nil
+}
+
+// List returns all namespaces including the default
+func (m *Manager) List() []*Namespace {
+	list := []*Namespace{{Name: DefaultName, Created: m.started}}
+
+	m.RLock()
+	for _, ns := range m.namespaces {
+		n := *ns.Namespace
+		list = append(list, &n)
+	}
+	m.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+// Resolve returns the namespace selected by name, falling back
+// to the namespace named after the identity, then the default
+func (m *Manager) Resolve(name, identity string) string {
+	if len(name) > 0 {
+		return name
+	}
+
+	if len(identity) > 0 {
+		m.RLock()
+		_, ok := m.namespaces[identity]
+		m.RUnlock()
+		if ok {
+			return identity
+		}
+	}
+
+	return DefaultName
+}
+
+// Broker returns the broker of the namespace
+func (m *Manager) Broker(name string) (broker.Broker, error) {
+	if name == DefaultName {
+		return m.broker(), nil
+	}
+
+	m.RLock()
+	ns, ok := m.namespaces[name]
+	m.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	return ns.broker, nil
+}
+
+// Allow returns an error if the identity is not allowed the action in the namespace
+func (m *Manager) Allow(name, identity string, action Action) error {
+	ns, err := m.Get(name)
+	if err != nil {
+		return err
+	}
+
+	if !ns.ACL.Allows(identity, action) {
+		rejected.Inc(name, "acl")
+		return fmt.Errorf("%w: %s not allowed in namespace %s", ErrForbidden, action, name)
+	}
+
+	return nil
+}
+
+// AllowAdmin returns an error if the identity is not allowed to manage namespaces
+func (m *Manager) AllowAdmin(identity string) error {
+	for _, id := range m.options.Admins {
+		if id == "*" || (len(identity) > 0 && id == identity) {
+			return nil
+		}
+	}
+	rejected.Inc(DefaultName, "acl")
+	return fmt.Errorf("%w: managing namespaces", ErrForbidden)
+}
+
+// Shutdown drains the subscribers of every namespace broker.
+// The broker of the default namespace is left to its owner.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.RLock()
+	var brokers []broker.Broker
+	for _, ns := range m.namespaces {
+		brokers = append(brokers, ns.broker)
+	}
+	m.RUnlock()
+
+	errCh := make(chan error, len(brokers))
+	for _, b := range brokers {
+		go func(b broker.Broker) {
+			errCh <- b.Shutdown(ctx)
+		}(b)
+	}
+
+	var err error
+	for range brokers {
+		if serr := <-errCh; serr != nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Close closes every namespace broker
+func (m *Manager) Close() error {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, ns := range m.namespaces {
+		ns.broker.Close()
+	}
+	return nil
+}
+
+// New returns a namespace manager creating the namespaces saved in the directory
+func New(opts ...Option) (*Manager, error) {
+	options := Options{
+		Dir: "namespaces",
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if options.Tracer == nil {
+		options.Tracer = trace.Default
+	}
+
+	if options.Logger == nil {
+		options.Logger = logger.Default
+	}
+
+	m := &Manager{
+		options:    options,
+		started:    time.Now(),
+		namespaces: make(map[string]*namespace),
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
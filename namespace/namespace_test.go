@@ -0,0 +1,190 @@
+package namespace
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asim/emque/broker"
+)
+
+func TestNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	def := broker.New()
+	defer def.Close()
+
+	m, err := New(Broker(def), Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Create(&Namespace{Name: "team-a", Persist: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Create(&Namespace{Name: "team-a"}); err == nil {
+		t.Fatal("expected duplicate namespace to fail")
+	}
+	if err := m.Create(&Namespace{Name: "../etc"}); err == nil {
+		t.Fatal("expected invalid name to fail")
+	}
+
+	a, err := m.Broker("team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := m.Broker(DefaultName); b != def {
+		t.Fatal("expected default namespace to use the default broker")
+	}
+	if _, err := m.Broker("team-b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found got %v", err)
+	}
+
+	// topics are isolated from the default namespace
+	ch, err := def.Subscribe("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Publish("orders", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ch:
+		t.Fatal("expected message not to be delivered to the default namespace")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "team-a", "orders.mq")); err != nil {
+		t.Fatalf("expected topic persisted to the namespace directory: %v", err)
+	}
+
+	if m.Resolve("", "team-a") != "team-a" || m.Resolve("", "other") != DefaultName {
+		t.Fatal("expected namespace resolved by identity")
+	}
+
+	m.Close()
+
+	// namespaces are recreated from the directory
+	m, err = New(Broker(def), Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if list := m.List(); len(list) != 2 || list[1].Name != "team-a" || !list[1].Persist {
+		t.Fatalf("expected saved namespace got %+v", list)
+	}
+
+	if err := m.Delete("team-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "team-a")); !os.IsNotExist(err) {
+		t.Fatal("expected namespace directory to be deleted")
+	}
+	if err := m.Delete(DefaultName); err == nil {
+		t.Fatal("expected default namespace not to be deleted")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := New(Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	err = m.Create(&Namespace{
+		Name: "quota",
+		Quota: &Quota{
+			MaxTopics:      1,
+			MaxSubscribers: 1,
+			MaxMessageSize: 3,
+			PublishRate:    2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := m.Broker("quota")
+
+	if _, err := b.Subscribe("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("foo"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected subscriber quota exceeded got %v", err)
+	}
+	if _, err := b.Fetch("bar"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected topic quota exceeded got %v", err)
+	}
+	if err := b.Publish("foo", []byte("toolong")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected message size quota exceeded got %v", err)
+	}
+
+	// bursts of up to the rate are allowed
+	for i := 0; i < 2; i++ {
+		if err := b.Publish("foo", []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Publish("foo", []byte("foo")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected publish rate quota exceeded got %v", err)
+	}
+}
+
+func TestACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := New(Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	err = m.Create(&Namespace{
+		Name: "acl",
+		ACL: &ACL{
+			Publish:   []string{"producer"},
+			Subscribe: []string{"*"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Allow("acl", "producer", Publish); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Allow("acl", "consumer", Publish); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected forbidden got %v", err)
+	}
+	if err := m.Allow("acl", "", Publish); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("expected anonymous forbidden got %v", err)
+	}
+	if err := m.Allow("acl", "", Subscribe); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Allow("acl", "", Admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Allow("missing", "", Publish); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package namespace
+
+import (
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/trace"
+)
+
+type Options struct {
+	// Broker of the default namespace. Defaults to broker.Default
+	Broker broker.Broker
+	// Directory namespace definitions and persisted topics are stored in.
+	// Topics of each namespace are stored in a directory named after it.
+	Dir    string
+	Tracer trace.Tracer
+	Logger logger.Logger
+	// Identities allowed to manage namespaces, * allows anyone.
+	// Namespaces are not managed remotely without any.
+	Admins []string
+}
+
+type Option func(o *Options)
+
+// Broker sets the broker of the default namespace
+func Broker(b broker.Broker) Option {
+	return func(o *Options) {
+		o.Broker = b
+	}
+}
+
+// Dir sets the directory namespaces are stored in
+func Dir(d string) Option {
+	return func(o *Options) {
+		o.Dir = d
+	}
+}
+
+// Tracer sets the tracer of namespace brokers
+func Tracer(t trace.Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = t
+	}
+}
+
+// Logger sets the logger of namespace brokers
+func Logger(l logger.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// Admins sets the identities allowed to manage namespaces
+func Admins(ids ...string) Option {
+	return func(o *Options) {
+		o.Admins = ids
+	}
+}
@@ -0,0 +1,189 @@
+package namespace
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/asim/emque/broker"
+)
+
+// quota enforces the namespace quota on the broker
+type quota struct {
+	broker.Broker
+
+	name  string
+	quota Quota
+	limit *limiter
+
+	// serialises creating topics and subscribers
+	sync.Mutex
+}
+
+// limiter is a token bucket allowing bursts of up to a second
+type limiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) allow() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	burst := l.rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// exceeded records the rejection and returns the quota error
+func (q *quota) exceeded(reason string, format string, args ...interface{}) error {
+	rejected.Inc(q.name, reason)
+	return fmt.Errorf("%w: %s", ErrQuotaExceeded, fmt.Sprintf(format, args...))
+}
+
+// create returns an error if creating the topic exceeds the quota
+func (q *quota) create(topic string) error {
+	if q.quota.MaxTopics <= 0 {
+		return nil
+	}
+	if _, err := q.Describe(topic); err == nil {
+		return nil
+	}
+	topics, err := q.Topics()
+	if err != nil {
+		return err
+	}
+	if len(topics) >= q.quota.MaxTopics {
+		return q.exceeded("topics", "max %d topics in namespace %s", q.quota.MaxTopics, q.name)
+	}
+	return nil
+}
+
+func (q *quota) Publish(topic string, payload []byte, opts ...broker.PublishOption) error {
+	if max := q.quota.MaxMessageSize; max > 0 && len(payload) > max {
+		return q.exceeded("message_size", "message size %d exceeds %d bytes", len(payload), max)
+	}
+
+	if q.limit != nil && !q.limit.allow() {
+		return q.exceeded("publish_rate", "publish rate %g/s in namespace %s", q.quota.PublishRate, q.name)
+	}
+
+	// topics are created on publish
+	if q.quota.MaxTopics > 0 {
+		q.Lock()
+		defer q.Unlock()
+		if err := q.create(topic); err != nil {
+			return err
+		}
+	}
+
+	return q.Broker.Publish(topic, payload, opts...)
+}
+
+// subscribe checks the quota before subscribing
+func (q *quota) subscribe(topic string, fn func() error) error {
+	if q.quota.MaxTopics <= 0 && q.quota.MaxSubscribers <= 0 {
+		return fn()
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if err := q.create(topic); err != nil {
+		return err
+	}
+
+	if max := q.quota.MaxSubscribers; max > 0 {
+		topics, err := q.Topics()
+		if err != nil {
+			return err
+		}
+		var n int
+		for _, t := range topics {
+			n += len(t.Subscribers)
+		}
+		if n >= max {
+			return q.exceeded("subscribers", "max %d subscribers in namespace %s", max, q.name)
+		}
+	}
+
+	return fn()
+}
+
+func (q *quota) Subscribe(topic string) (<-chan []byte, error) {
+	var ch <-chan []byte
+	err := q.subscribe(topic, func() (err error) {
+		ch, err = q.Broker.Subscribe(topic)
+		return err
+	})
+	return ch, err
+}
+
+func (q *quota) SubscribeMessages(topic string, opts ...broker.SubscribeOption) (<-chan *broker.Message, error) {
+	var ch <-chan *broker.Message
+	err := q.subscribe(topic, func() (err error) {
+		ch, err = q.Broker.SubscribeMessages(topic, opts...)
+		return err
+	})
+	return ch, err
+}
+
+func (q *quota) Fetch(topic string, opts ...broker.FetchOption) ([]*broker.Message, error) {
+	if q.quota.MaxTopics > 0 {
+		q.Lock()
+		err := q.create(topic)
+		q.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q.Broker.Fetch(topic, opts...)
+}
+
+func (q *quota) SetPersist(topic string, persist bool) error {
+	if q.quota.MaxTopics > 0 {
+		q.Lock()
+		defer q.Unlock()
+		if err := q.create(topic); err != nil {
+			return err
+		}
+	}
+	return q.Broker.SetPersist(topic, persist)
+}
+
+func newQuota(b broker.Broker, ns *Namespace) broker.Broker {
+	q := &quota{
+		Broker: b,
+		name:   ns.Name,
+	}
+
+	if ns.Quota != nil {
+		q.quota = *ns.Quota
+	}
+
+	if q.quota.PublishRate > 0 {
+		q.limit = &limiter{
+			rate:   q.quota.PublishRate,
+			tokens: q.quota.PublishRate,
+			last:   time.Now(),
+		}
+	}
+
+	return q
+}
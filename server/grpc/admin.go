@@ -0,0 +1,82 @@
+package grpc
+
+import (
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/namespace"
+	"github.com/asim/emque/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// topic returns the topic description as a proto topic
+func topic(t *broker.Topic) *mq.Topic {
+	pt := &mq.Topic{
+		Name:     t.Name,
+		Offset:   t.Offset,
+		Persist:  t.Persist,
+		Buffered: int32(t.Buffered),
+		Groups:   t.Groups,
+	}
+	for _, sub := range t.Subscribers {
+		pt.Subscribers = append(pt.Subscribers, &mq.Subscriber{
+			Id:       sub.Id,
+			Metadata: sub.Metadata,
+			Created:  sub.Created.UnixNano(),
+			Buffer:   int32(sub.Buffer),
+			Capacity: int32(sub.Capacity),
+			Dropped:  sub.Dropped,
+		})
+	}
+	return pt
+}
+
+func (h *handler) ListTopics(ctx context.Context, req *mq.ListTopicsRequest) (*mq.ListTopicsResponse, error) {
+	b, err := h.resolve(ctx, namespace.Admin)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := b.Topics()
+	if err != nil {
+		return nil, errorf("list error: %v", err)
+	}
+
+	rsp := new(mq.ListTopicsResponse)
+	for _, t := range list {
+		rsp.Topics = append(rsp.Topics, topic(t))
+	}
+	return rsp, nil
+}
+
+func (h *handler) DescribeTopic(ctx context.Context, req *mq.DescribeTopicRequest) (*mq.DescribeTopicResponse, error) {
+	b, err := h.resolve(ctx, namespace.Admin)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := b.Describe(req.Name)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return &mq.DescribeTopicResponse{Topic: topic(t)}, nil
+}
+
+func (h *handler) DeleteTopic(ctx context.Context, req *mq.DeleteTopicRequest) (*mq.DeleteTopicResponse, error) {
+	b, err := h.resolve(ctx, namespace.Admin)
+	if err != nil {
+		return nil, err
+	}
+
+	// only topics which exist are deleted
+	if _, err := b.Describe(req.Name); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if err := b.Delete(req.Name); err != nil {
+		return nil, errorf("delete error: %v", err)
+	}
+
+	return new(mq.DeleteTopicResponse), nil
+}
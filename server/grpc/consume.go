@@ -0,0 +1,220 @@
+package grpc
+
+import (
+	"io"
+	"time"
+
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/namespace"
+	"github.com/asim/emque/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// consumeWait is how long Consume waits for messages between acknowledgements
+var consumeWait = time.Second
+
+// group identifies a consumer group of a topic in a broker
+type group struct {
+	broker broker.Broker
+	topic  string
+	name   string
+}
+
+// claim claims the group for a stream. A group is consumed by one stream
+// at a time as each stream tracks the messages in flight itself.
+func (h *handler) claim(g group) error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.consumers[g] {
+		return status.Errorf(codes.AlreadyExists, "group %s is already consuming topic %s", g.name, g.topic)
+	}
+	h.consumers[g] = true
+	return nil
+}
+
+func (h *handler) release(g group) {
+	h.Lock()
+	delete(h.consumers, g)
+	h.Unlock()
+}
+
+// consumer tracks the messages delivered to a Consume stream
+type consumer struct {
+	broker broker.Broker
+	stream mq.MQ_ConsumeServer
+	topic  string
+	group  string
+	// max number of unacknowledged messages
+	window int
+	// next id fetched, zero for the group position
+	cursor int64
+	// delivered messages waiting to be acknowledged
+	inflight map[int64]*broker.Message
+}
+
+// commit commits the group position up to the oldest unacknowledged message
+func (c *consumer) commit() error {
+	offset := c.cursor
+	for id := range c.inflight {
+		if id < offset {
+			offset = id
+		}
+	}
+	if offset <= 0 {
+		return nil
+	}
+	return c.broker.Commit(c.topic, c.group, offset)
+}
+
+// ack acknowledges and redelivers the messages of the request
+func (h *handler) ack(c *consumer, req *mq.ConsumeRequest) error {
+	for _, id := range req.Nack {
+		m, ok := c.inflight[id]
+		if !ok {
+			continue
+		}
+		if err := h.deliver(c.stream.Context(), m, func() error {
+			return c.stream.Send(message(m))
+		}); err != nil {
+			return err
+		}
+	}
+
+	if len(req.Ack) == 0 {
+		return nil
+	}
+
+	for _, id := range req.Ack {
+		delete(c.inflight, id)
+	}
+
+	if err := c.commit(); err != nil {
+		return errorf("commit error: %v", err)
+	}
+	return nil
+}
+
+// Consume delivers messages to the consumer group up to the max in flight
+// and commits the group position as they are acknowledged. Messages not
+// acknowledged are delivered again to the group when the stream ends.
+func (h *handler) Consume(stream mq.MQ_ConsumeServer) error {
+	ctx := stream.Context()
+
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(req.Topic) == 0 {
+		return status.Error(codes.InvalidArgument, "topic required")
+	}
+
+	b, err := h.resolve(ctx, namespace.Subscribe)
+	if err != nil {
+		return err
+	}
+
+	c := &consumer{
+		broker:   b,
+		stream:   stream,
+		topic:    req.Topic,
+		group:    req.Group,
+		window:   int(req.MaxInflight),
+		inflight: make(map[int64]*broker.Message),
+	}
+
+	if len(c.group) == 0 {
+		c.group = "default"
+	}
+
+	if c.window <= 0 {
+		c.window = 100
+	}
+
+	g := group{broker: b, topic: c.topic, name: c.group}
+	if err := h.claim(g); err != nil {
+		return err
+	}
+	defer h.release(g)
+
+	// acknowledgements are received while fetching
+	acks := make(chan *mq.ConsumeRequest)
+	errCh := make(chan error, 1)
+
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case acks <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// selected when there is room in the window
+	room := make(chan bool)
+	close(room)
+
+	for {
+		// handle acknowledgements, waiting for them while the window is full
+		for {
+			var wait <-chan bool
+			if len(c.inflight) < c.window {
+				wait = room
+			}
+
+			select {
+			case req := <-acks:
+				if err := h.ack(c, req); err != nil {
+					return err
+				}
+				continue
+			case err := <-errCh:
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			case <-h.exit:
+				return status.Error(codes.Unavailable, "server shutting down")
+			case <-wait:
+			}
+			break
+		}
+
+		msgs, err := b.Fetch(c.topic,
+			broker.Group(c.group),
+			broker.From(c.cursor),
+			broker.Commit(false),
+			broker.Max(c.window-len(c.inflight)),
+			broker.Wait(consumeWait),
+			broker.FetchContext(ctx),
+		)
+		if err != nil {
+			if h.shutdown(b) {
+				return status.Error(codes.Unavailable, "server shutting down")
+			}
+			return errorf("fetch error: %v", err)
+		}
+
+		for _, m := range msgs {
+			c.inflight[m.Id] = m
+			c.cursor = m.Id + 1
+
+			if err := h.deliver(ctx, m, func() error {
+				return stream.Send(message(m))
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -1,22 +1,79 @@
 package grpc
 
 import (
-	"net"
+	"net/http"
 
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/logger"
 	mq "github.com/asim/emque/proto"
 	"github.com/asim/emque/server"
 	"github.com/asim/emque/server/util"
+	"github.com/asim/emque/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 type grpcServer struct {
 	options *server.Options
 	srv     *grpc.Server
+	health  *health
+	mq      *handler
+
+	// used to serve via a http server
+	handler *grpc.Server
+}
+
+func (g *grpcServer) newServer(opts ...grpc.ServerOption) *grpc.Server {
+	options := g.options.GRPC
+
+	unary := []grpc.UnaryServerInterceptor{
+		unaryMetrics,
+		unaryLogger(g.options.Logger),
+		unaryRecovery,
+	}
+	stream := []grpc.StreamServerInterceptor{
+		streamMetrics,
+		streamLogger(g.options.Logger),
+		streamRecovery,
+	}
+
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(append(unary, options.UnaryInterceptors...)...),
+		grpc.ChainStreamInterceptor(append(stream, options.StreamInterceptors...)...),
+	)
+
+	if options.Keepalive != nil {
+		opts = append(opts, grpc.KeepaliveParams(*options.Keepalive))
+	}
+
+	if options.KeepalivePolicy != nil {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(*options.KeepalivePolicy))
+	}
+
+	if options.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(options.MaxConcurrentStreams))
+	}
+
+	srv := grpc.NewServer(opts...)
+
+	// register MQ server
+	mq.RegisterMQServer(srv, g.mq)
+
+	// register health server
+	healthpb.RegisterHealthServer(srv, g.health)
+
+	// register reflection server
+	if options.Reflection {
+		reflection.Register(srv)
+	}
+
+	return srv
 }
 
 func (g *grpcServer) Run() error {
-	l, err := net.Listen("tcp", g.options.Address)
+	l, err := util.Listen(g.options.Address)
 	if err != nil {
 		return err
 	}
@@ -24,46 +81,43 @@ func (g *grpcServer) Run() error {
 	var opts []grpc.ServerOption
 
 	// tls enabled
-	if g.options.TLS != nil {
-		creds, err := credentials.NewServerTLSFromFile(
-			g.options.TLS.CertFile,
-			g.options.TLS.KeyFile,
-		)
+	if !g.options.Insecure && !util.IsUnix(g.options.Address) {
+		config, err := server.TLSConfig(g.options)
 		if err != nil {
 			return err
 		}
-		opts = append(opts, grpc.Creds(creds))
-	} else {
-		// generate tls config
-		addr, err := util.Address(g.options.Address)
-		if err != nil {
-			return err
-		}
-
-		cert, err := util.Certificate(addr)
-		if err != nil {
-			return err
-		}
-
-		creds := credentials.NewServerTLSFromCert(&cert)
-		opts = append(opts, grpc.Creds(creds))
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
 	}
 
 	// new grpc server
-	srv := grpc.NewServer(opts...)
+	srv := g.newServer(opts...)
 	g.srv = srv
 
-	// register MQ server
-	mq.RegisterMQServer(srv, new(handler))
-
 	// serve
 	return srv.Serve(l)
 }
 
+// ServeHTTP serves gRPC requests received by a http server.
+// TLS is handled by the http server.
+func (g *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.handler.ServeHTTP(w, r)
+}
+
+// Stop stops accepting connections and waits for RPCs to complete.
+// Subscriptions complete once closed by the broker. RPCs received
+// via ServeHTTP are drained by the http server.
 func (g *grpcServer) Stop() error {
-	g.srv.GracefulStop()
+	select {
+	case <-g.mq.exit:
+		return nil
+	default:
+		close(g.mq.exit)
+	}
+	g.health.Stop()
+	if g.srv != nil {
+		g.srv.GracefulStop()
+	}
 	return nil
-
 }
 
 func New(opts ...server.Option) *grpcServer {
@@ -71,7 +125,32 @@ func New(opts ...server.Option) *grpcServer {
 	for _, o := range opts {
 		o(options)
 	}
-	return &grpcServer{
+
+	if options.Tracer == nil {
+		options.Tracer = trace.Default
+	}
+
+	if options.Logger == nil {
+		options.Logger = logger.Default
+	}
+
+	if options.Broker == nil {
+		options.Broker = broker.Default
+	}
+
+	g := &grpcServer{
 		options: options,
+		health:  newHealth(options.Broker),
+		mq: &handler{
+			broker:     options.Broker,
+			namespaces: options.Namespaces,
+			admins:     options.Admins,
+			consumers:  make(map[group]bool),
+			tracer:     options.Tracer,
+			exit:       make(chan bool),
+		},
 	}
+	g.handler = g.newServer()
+
+	return g
 }
@@ -0,0 +1,376 @@
+package grpc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asim/emque/broker"
+	mq "github.com/asim/emque/proto"
+	"github.com/asim/emque/server"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+func TestBroker(t *testing.T) {
+	a, b := broker.New(), broker.New()
+	defer a.Close()
+
+	ga := New(server.WithBroker(a))
+	gb := New(server.WithBroker(b))
+	defer ga.Stop()
+	defer gb.Stop()
+
+	ch, err := a.SubscribeMessages("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// published to broker b only
+	if _, err := gb.mq.Pub(context.TODO(), &mq.PubRequest{Topic: "foo", Payload: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ga.mq.Pub(context.TODO(), &mq.PubRequest{Topic: "foo", Payload: []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ga.mq.Pub(context.TODO(), &mq.PubRequest{Topic: "../foo", Payload: []byte("a")}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument got %v", err)
+	}
+
+	select {
+	case m := <-ch:
+		if string(m.Payload) != "a" {
+			t.Fatalf("expected message a got %s", string(m.Payload))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+
+	rsp, err := ga.mq.PubBatch(context.TODO(), &mq.PubBatchRequest{
+		Messages: []*mq.PubRequest{
+			{Topic: "foo", Payload: []byte("1")},
+			{Topic: "foo", Payload: []byte("2")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Errors) != 2 || len(rsp.Errors[0]) > 0 || len(rsp.Errors[1]) > 0 {
+		t.Fatalf("expected 2 messages published got %v", rsp.Errors)
+	}
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-ch:
+			got[string(m.Payload)] = true
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+	if !got["1"] || !got["2"] {
+		t.Fatalf("expected batch published got %v", got)
+	}
+
+	// health reflects the bound broker
+	for i := 0; a.Ready() != nil; i++ {
+		if i > 100 {
+			t.Fatalf("broker not ready: %v", a.Ready())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	b.Close()
+	ga.health.update()
+	gb.health.update()
+
+	for g, want := range map[*grpcServer]healthpb.HealthCheckResponse_ServingStatus{
+		ga: healthpb.HealthCheckResponse_SERVING,
+		gb: healthpb.HealthCheckResponse_NOT_SERVING,
+	} {
+		rsp, err := g.health.Check(context.TODO(), &healthpb.HealthCheckRequest{Service: "mq.MQ"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.Status != want {
+			t.Fatalf("expected %v got %v", want, rsp.Status)
+		}
+	}
+}
+
+// serve runs the server on a unix socket returning a connection to it
+func serve(t *testing.T, opts ...server.Option) (*grpc.ClientConn, func()) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := "unix://" + filepath.Join(dir, "mq.sock")
+
+	srv := New(append([]server.Option{server.WithAddress(addr), server.WithInsecure(true)}, opts...)...)
+	go srv.Run()
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, func() {
+		conn.Close()
+		srv.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConsume(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+
+	conn, stop := serve(t, server.WithBroker(b), server.WithAdmins("*"))
+	defer stop()
+
+	c := mq.NewMQClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// not buffered until the consumer fetches the topic
+	if err := b.Publish("foo", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := c.Consume(ctx, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&mq.ConsumeRequest{Topic: "foo", MaxInflight: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	recv := func(want int64) {
+		m, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Id != want {
+			t.Fatalf("expected message %d got %d", want, m.Id)
+		}
+	}
+
+	// wait for the consumer group to fetch the topic
+	for i := 0; ; i++ {
+		if info, err := b.Describe("foo"); err == nil && len(info.Groups) > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("topic not fetched")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := b.Publish("foo", []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the max in flight are delivered until acknowledged
+	recv(2)
+	recv(3)
+
+	// the group is consumed by one stream at a time
+	second, err := c.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Send(&mq.ConsumeRequest{Topic: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Recv(); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected already exists got %v", err)
+	}
+
+	if err := stream.Send(&mq.ConsumeRequest{Ack: []int64{2}, Nack: []int64{3}}); err != nil {
+		t.Fatal(err)
+	}
+	recv(3)
+	recv(4)
+
+	// the group position is the oldest unacknowledged message
+	rsp, err := c.DescribeTopic(ctx, &mq.DescribeTopicRequest{Name: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Topic.Groups["default"] != 3 {
+		t.Fatalf("expected group position 3 got %d", rsp.Topic.Groups["default"])
+	}
+
+	list, err := c.ListTopics(ctx, &mq.ListTopicsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Topics) != 1 || list.Topics[0].Name != "foo" || len(list.Topics[0].Subscribers) != 0 {
+		t.Fatalf("expected topic foo got %+v", list.Topics)
+	}
+
+	if _, err := c.DeleteTopic(ctx, &mq.DeleteTopicRequest{Name: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DescribeTopic(ctx, &mq.DescribeTopicRequest{Name: "foo"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected not found got %v", err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+
+	// the admin API is disabled without admins
+	conn, stop := serve(t, server.WithBroker(b))
+	defer stop()
+
+	c := mq.NewMQClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := c.Pub(ctx, &mq.PubRequest{Topic: "foo", Payload: []byte("foo")}, grpc.WaitForReady(true)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.ListTopics(ctx, &mq.ListTopicsRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected permission denied got %v", err)
+	}
+	if _, err := c.DeleteTopic(ctx, &mq.DeleteTopicRequest{Name: "foo"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected permission denied got %v", err)
+	}
+	if _, err := b.Describe("foo"); err != nil {
+		t.Fatal("expected topic not to be deleted")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+
+	conn, stop := serve(t, server.WithBroker(b))
+	defer stop()
+
+	c := mq.NewMQClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	fetch := func(group string, max int32, want ...int64) {
+		rsp, err := c.Fetch(ctx, &mq.FetchRequest{Topic: "foo", Group: group, Max: max}, grpc.WaitForReady(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rsp.Messages) != len(want) {
+			t.Fatalf("group %s: expected %d messages got %d", group, len(want), len(rsp.Messages))
+		}
+		for i, m := range rsp.Messages {
+			if m.Id != want[i] {
+				t.Fatalf("group %s: expected message %d got %d", group, want[i], m.Id)
+			}
+		}
+	}
+
+	// not buffered until the topic is fetched
+	b.Publish("foo", []byte("foo"))
+	fetch("a", 0)
+	fetch("b", 0)
+	for i := 0; i < 3; i++ {
+		if err := b.Publish("foo", []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each group continues from its own position
+	fetch("a", 2, 2, 3)
+	fetch("a", 2, 4)
+	fetch("b", 0, 2, 3, 4)
+	fetch("a", 0)
+
+	// wait for new messages
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		b.Publish("foo", []byte("foo"))
+	}()
+
+	rsp, err := c.Fetch(ctx, &mq.FetchRequest{Topic: "foo", Group: "a", Wait: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsp.Messages) != 1 || rsp.Messages[0].Id != 5 {
+		t.Fatalf("expected message 5 got %+v", rsp.Messages)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+
+	var calls []string
+
+	conn, stop := serve(t,
+		server.WithBroker(b),
+		server.WithReflection(true),
+		server.WithUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, info.FullMethod)
+			if _, ok := req.(*mq.DeleteTopicRequest); ok {
+				panic("delete")
+			}
+			return handler(ctx, req)
+		}),
+	)
+	defer stop()
+
+	c := mq.NewMQClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	if _, err := c.Pub(ctx, &mq.PubRequest{Topic: "foo", Payload: []byte("foo")}, grpc.WaitForReady(true)); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] != "/mq.MQ/Pub" {
+		t.Fatalf("expected interceptor to be called for Pub got %v", calls)
+	}
+
+	// panics are recovered as internal errors
+	if _, err := c.DeleteTopic(ctx, &mq.DeleteTopicRequest{Name: "foo"}); status.Code(err) != codes.Internal {
+		t.Fatalf("expected internal error got %v", err)
+	}
+
+	// the reflection service lists the MQ service
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Send(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, svc := range rsp.GetListServicesResponse().GetService() {
+		if svc.Name == "mq.MQ" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected reflection to list mq.MQ")
+	}
+}
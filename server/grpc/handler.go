@@ -1,34 +1,341 @@
 package grpc
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"sync"
+	"time"
 
 	"github.com/asim/emque/broker"
+	"github.com/asim/emque/namespace"
 	"github.com/asim/emque/proto"
+	"github.com/asim/emque/server"
+	"github.com/asim/emque/trace"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
-type handler struct{}
+type handler struct {
+	broker broker.Broker
+	// namespaces served in addition to the broker, may be nil
+	namespaces *namespace.Manager
+	// identities allowed to use the admin API
+	admins []string
+	tracer trace.Tracer
+	// closed when the server stops
+	exit chan bool
+
+	sync.Mutex
+	// consumer groups with a Consume stream
+	consumers map[group]bool
+}
+
+// headers returns the request headers with the
+// trace context from the metadata if not set
+func headers(ctx context.Context, hdr map[string]string) map[string]string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return hdr
+	}
+	if _, ok := hdr[trace.TraceparentHeader]; ok {
+		return hdr
+	}
+
+	h := make(map[string]string, len(hdr)+2)
+	for k, v := range hdr {
+		h[k] = v
+	}
+	for _, k := range []string{trace.TraceparentHeader, trace.TracestateHeader} {
+		if v := md.Get(k); len(v) > 0 {
+			h[k] = v[0]
+		}
+	}
+	return h
+}
+
+// message returns the broker message as a proto message
+func message(m *broker.Message) *mq.Message {
+	return &mq.Message{
+		Id:        m.Id,
+		Timestamp: m.Timestamp,
+		Topic:     m.Topic,
+		Payload:   m.Payload,
+		Headers:   m.Headers,
+	}
+}
+
+// deliver sends the message within a delivery span
+func (h *handler) deliver(ctx context.Context, m *broker.Message, send func() error) error {
+	ctx = trace.ExtractContext(ctx, m.Headers)
+	_, span := h.tracer.Start(ctx, "deliver")
+	defer span.End()
+
+	span.SetAttribute("topic", m.Topic)
+	span.SetAttribute("transport", "grpc")
+
+	err := send()
+	span.SetError(err)
+	return err
+}
+
+// shutdown returns true if the server or broker is shutting down
+func (h *handler) shutdown(b broker.Broker) bool {
+	select {
+	case <-h.exit:
+		return true
+	default:
+	}
+	return b.Ready() != nil
+}
+
+// errorf returns the error with the status code of namespace and topic errors
+func errorf(format string, err error) error {
+	var c codes.Code
+	switch {
+	case errors.Is(err, namespace.ErrNotFound):
+		c = codes.NotFound
+	case errors.Is(err, namespace.ErrForbidden):
+		c = codes.PermissionDenied
+	case errors.Is(err, namespace.ErrQuotaExceeded):
+		c = codes.ResourceExhausted
+	case errors.Is(err, broker.ErrInvalidTopic):
+		c = codes.InvalidArgument
+	case errors.Is(err, context.Canceled):
+		c = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		c = codes.DeadlineExceeded
+	default:
+		return fmt.Errorf(format, err)
+	}
+	return status.Errorf(c, format, err)
+}
+
+// resolve returns the broker of the namespace selected by
+// metadata or client certificate if allowed the action
+func (h *handler) resolve(ctx context.Context, action namespace.Action) (broker.Broker, error) {
+	var name, identity string
+
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			identity = namespace.Identity(&info.State)
+		}
+	}
+
+	// only admins use the admin API of any namespace
+	if action == namespace.Admin {
+		if err := server.AllowAdmin(h.admins, identity); err != nil {
+			return nil, errorf("%v", err)
+		}
+	}
+
+	if h.namespaces == nil {
+		return h.broker, nil
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(namespace.Header); len(v) > 0 {
+			name = v[0]
+		}
+	}
+
+	name = h.namespaces.Resolve(name, identity)
+	if err := h.namespaces.Allow(name, identity, action); err != nil {
+		return nil, errorf("%v", err)
+	}
+
+	if name == namespace.DefaultName {
+		return h.broker, nil
+	}
+
+	b, err := h.namespaces.Broker(name)
+	if err != nil {
+		return nil, errorf("%v", err)
+	}
+	return b, nil
+}
 
 func (h *handler) Pub(ctx context.Context, req *mq.PubRequest) (*mq.PubResponse, error) {
-	if err := broker.Publish(req.Topic, req.Payload); err != nil {
-		return nil, fmt.Errorf("pub error: %v", err)
+	opts := []broker.PublishOption{
+		broker.Headers(headers(ctx, req.Headers)),
+		broker.Context(ctx),
+	}
+	b, err := h.resolve(ctx, namespace.Publish)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Publish(req.Topic, req.Payload, opts...); err != nil {
+		return nil, errorf("pub error: %v", err)
 	}
 	return new(mq.PubResponse), nil
 }
 
+// PubBatch publishes the messages returning the error publishing each
+func (h *handler) PubBatch(ctx context.Context, req *mq.PubBatchRequest) (*mq.PubBatchResponse, error) {
+	b, err := h.resolve(ctx, namespace.Publish)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp := &mq.PubBatchResponse{
+		Errors: make([]string, len(req.Messages)),
+	}
+
+	for i, m := range req.Messages {
+		if err := b.Publish(m.Topic, m.Payload,
+			broker.Headers(headers(ctx, m.Headers)),
+			broker.Context(ctx),
+		); err != nil {
+			rsp.Errors[i] = err.Error()
+		}
+	}
+
+	return rsp, nil
+}
+
+// PubStream publishes each message received on the stream and
+// acknowledges it with the error publishing it if any
+func (h *handler) PubStream(stream mq.MQ_PubStreamServer) error {
+	ctx := stream.Context()
+
+	b, err := h.resolve(ctx, namespace.Publish)
+	if err != nil {
+		return err
+	}
+
+	// messages are received while waiting for the server to stop
+	reqs := make(chan *mq.PubRequest)
+	errCh := make(chan error, 1)
+
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		var req *mq.PubRequest
+
+		select {
+		case req = <-reqs:
+		case err := <-errCh:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-h.exit:
+			return status.Error(codes.Unavailable, "server shutting down")
+		}
+
+		ack := &mq.PubAck{Seq: req.Seq}
+		if err := b.Publish(req.Topic, req.Payload,
+			broker.Headers(headers(ctx, req.Headers)),
+			broker.Context(ctx),
+		); err != nil {
+			ack.Error = err.Error()
+		}
+
+		if err := stream.Send(ack); err != nil {
+			return err
+		}
+	}
+}
+
 func (h *handler) Sub(req *mq.SubRequest, stream mq.MQ_SubServer) error {
-	ch, err := broker.Subscribe(req.Topic)
+	md := map[string]string{
+		"transport": "grpc",
+	}
+
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		md["remote"] = p.Addr.String()
+	}
+
+	b, err := h.resolve(stream.Context(), namespace.Subscribe)
+	if err != nil {
+		return err
+	}
+
+	ch, err := b.SubscribeMessages(req.Topic, broker.Metadata(md), broker.Offset(req.Offset))
 	if err != nil {
-		return fmt.Errorf("could not subscribe: %v", err)
+		return errorf("could not subscribe: %v", err)
 	}
-	defer broker.Unsubscribe(req.Topic, ch)
+	defer b.UnsubscribeMessages(req.Topic, ch)
+
+	for {
+		var m *broker.Message
+		var ok bool
+
+		select {
+		case m, ok = <-ch:
+		// cancelled by the client
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
 
-	for p := range ch {
-		if err := stream.Send(&mq.SubResponse{Payload: p}); err != nil {
+		if !ok {
+			break
+		}
+
+		err := h.deliver(stream.Context(), m, func() error {
+			return stream.Send(&mq.SubResponse{
+				Payload:   m.Payload,
+				Headers:   m.Headers,
+				Id:        m.Id,
+				Timestamp: m.Timestamp,
+				Topic:     m.Topic,
+			})
+		})
+		if err != nil {
 			return fmt.Errorf("failed to send payload: %v", err)
 		}
 	}
 
+	// closed by the broker on shutdown
+	if h.shutdown(b) {
+		return status.Error(codes.Unavailable, "server shutting down")
+	}
+
 	return nil
 }
+
+func (h *handler) Fetch(ctx context.Context, req *mq.FetchRequest) (*mq.FetchResponse, error) {
+	opts := []broker.FetchOption{
+		broker.Max(int(req.Max)),
+		broker.Wait(time.Duration(req.Wait) * time.Millisecond),
+		broker.FetchContext(ctx),
+	}
+
+	if len(req.Group) > 0 {
+		opts = append(opts, broker.Group(req.Group))
+	}
+
+	b, err := h.resolve(ctx, namespace.Subscribe)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := b.Fetch(req.Topic, opts...)
+	if err != nil {
+		return nil, errorf("fetch error: %v", err)
+	}
+
+	rsp := new(mq.FetchResponse)
+	for _, m := range msgs {
+		rsp.Messages = append(rsp.Messages, message(m))
+	}
+
+	return rsp, nil
+}
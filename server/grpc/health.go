@@ -0,0 +1,65 @@
+package grpc
+
+import (
+	"time"
+
+	"github.com/asim/emque/broker"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var (
+	// HealthInterval is how often the serving status is updated
+	HealthInterval = time.Second
+)
+
+// health reports the readiness of the broker via the grpc.health.v1 service
+type health struct {
+	*grpchealth.Server
+	broker broker.Broker
+	exit   chan bool
+}
+
+func (h *health) update() {
+	status := healthpb.HealthCheckResponse_SERVING
+	if err := h.broker.Ready(); err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	h.SetServingStatus("", status)
+	h.SetServingStatus("mq.MQ", status)
+}
+
+func (h *health) run() {
+	tick := time.NewTicker(HealthInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			h.update()
+		case <-h.exit:
+			return
+		}
+	}
+}
+
+// Stop stops updates and reports not serving
+func (h *health) Stop() {
+	select {
+	case <-h.exit:
+	default:
+		close(h.exit)
+		h.Shutdown()
+	}
+}
+
+func newHealth(b broker.Broker) *health {
+	h := &health{
+		Server: grpchealth.NewServer(),
+		broker: b,
+		exit:   make(chan bool),
+	}
+	h.update()
+	go h.run()
+	return h
+}
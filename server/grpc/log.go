@@ -0,0 +1,66 @@
+package grpc
+
+import (
+	"time"
+
+	"github.com/asim/emque/logger"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// stream overrides the context of a server stream
+type stream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *stream) Context() context.Context {
+	return s.ctx
+}
+
+// requestLogger returns the logger for the request
+func requestLogger(ctx context.Context, log logger.Logger, method string) logger.Logger {
+	fields := []interface{}{"method", method}
+	if p, ok := peer.FromContext(ctx); ok {
+		fields = append(fields, "remote", p.Addr.String())
+	}
+	return log.With(fields...)
+}
+
+// logRequest logs the outcome of a request
+func logRequest(log logger.Logger, start time.Time, err error) {
+	fields := []interface{}{"code", status.Code(err), "duration", time.Since(start)}
+	if err != nil {
+		log.Error("Request failed", append(fields, "error", err)...)
+		return
+	}
+	log.Info("Request", fields...)
+}
+
+// unaryLogger logs unary requests. Handlers log via the request logger in the context.
+func unaryLogger(log logger.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		rlog := requestLogger(ctx, log, info.FullMethod)
+
+		rsp, err := handler(logger.NewContext(ctx, rlog), req)
+
+		logRequest(rlog, start, err)
+		return rsp, err
+	}
+}
+
+// streamLogger logs streaming requests when they end
+func streamLogger(log logger.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		rlog := requestLogger(ss.Context(), log, info.FullMethod)
+
+		err := handler(srv, &stream{ss, logger.NewContext(ss.Context(), rlog)})
+
+		logRequest(rlog, start, err)
+		return err
+	}
+}
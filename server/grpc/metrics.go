@@ -0,0 +1,22 @@
+package grpc
+
+import (
+	"github.com/asim/emque/metrics"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var requests = metrics.NewCounter("emque_grpc_requests_total", "gRPC requests by method and status code.", "method", "code")
+
+func unaryMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	rsp, err := handler(ctx, req)
+	requests.Inc(info.FullMethod, status.Code(err).String())
+	return rsp, err
+}
+
+func streamMetrics(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, ss)
+	requests.Inc(info.FullMethod, status.Code(err).String())
+	return err
+}
@@ -0,0 +1,37 @@
+package grpc
+
+import (
+	"runtime/debug"
+
+	"github.com/asim/emque/logger"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recovered logs the panic with the request logger and returns an internal error
+func recovered(ctx context.Context, r interface{}) error {
+	logger.FromContext(ctx).Error("Panic handling request", "panic", r, "stack", string(debug.Stack()))
+	return status.Error(codes.Internal, "internal error")
+}
+
+// unaryRecovery recovers panics in unary handlers
+func unaryRecovery(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (rsp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recovered(ctx, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// streamRecovery recovers panics in stream handlers
+func streamRecovery(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recovered(ss.Context(), r)
+		}
+	}()
+	return handler(srv, ss)
+}
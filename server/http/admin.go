@@ -0,0 +1,171 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/asim/emque/namespace"
+	"github.com/asim/emque/server"
+	"github.com/asim/emque/webhook"
+)
+
+// writeJSON writes the value as the JSON response
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes the error as a JSON response
+func writeError(w http.ResponseWriter, code int, err string) {
+	writeJSON(w, code, map[string]string{"error": err})
+}
+
+// admin only allows the admins to call the handler
+func (h *Handler) admin(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := server.AllowAdmin(h.options.Admins, namespace.Identity(r.TLS)); err != nil {
+			writeError(w, code(err), err.Error())
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// webhooks handles /admin/v1/webhooks and /admin/v1/webhooks/{id}
+func (h *Handler) webhooks(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, h.options.Prefix+"/admin/v1/webhooks"), "/")
+
+	switch {
+	case len(id) == 0 && r.Method == "GET":
+		list := h.hooks.List()
+		if list == nil {
+			list = []*webhook.Status{}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case len(id) == 0 && r.Method == "POST":
+		hook := new(webhook.Webhook)
+		if err := json.NewDecoder(r.Body).Decode(hook); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := h.hooks.Register(hook); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		status, err := h.hooks.Get(hook.Id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, status)
+	case len(id) > 0 && r.Method == "GET":
+		status, err := h.hooks.Get(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	case len(id) > 0 && r.Method == "DELETE":
+		if err := h.hooks.Deregister(id); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// config handles /admin/v1/config returning the server config and uptime
+func (h *Handler) config(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	options := h.options.Server
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"server": map[string]interface{}{
+			"address":     options.Address,
+			"tls":         options.TLS,
+			"client_auth": options.ClientAuth,
+			"cert_dir":    options.CertDir,
+			"insecure":    options.Insecure,
+		},
+		"started": h.started,
+		"uptime":  time.Since(h.started).Round(time.Second).String(),
+	})
+}
+
+// topics handles /admin/v1/topics and the actions on a topic
+//
+//	GET	/admin/v1/topics
+//	GET	/admin/v1/topics/{name}
+//	POST	/admin/v1/topics/{name}/purge
+//	PUT	/admin/v1/topics/{name}/persist
+//	DELETE	/admin/v1/topics/{name}
+//	DELETE	/admin/v1/topics/{name}/subscribers/{id}
+func (h *Handler) topics(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, h.options.Prefix+"/admin/v1/topics"), "/")
+
+	switch {
+	case len(path) == 0 && r.Method == "GET":
+		list, err := h.broker.Topics()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case strings.Contains(path, "/subscribers/") && r.Method == "DELETE":
+		i := strings.LastIndex(path, "/subscribers/")
+		topic, id := path[:i], path[i+len("/subscribers/"):]
+		if err := h.broker.Kick(topic, id); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(path) > 0 && r.Method == "DELETE":
+		if err := h.broker.Delete(path); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/purge") && r.Method == "POST":
+		topic := strings.TrimSuffix(path, "/purge")
+		if err := h.broker.Purge(topic); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(path, "/persist") && r.Method == "PUT":
+		topic := strings.TrimSuffix(path, "/persist")
+		var req struct {
+			Persist bool `json:"persist"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := h.broker.SetPersist(topic, req.Persist); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		info, err := h.broker.Describe(topic)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	case len(path) > 0 && r.Method == "GET":
+		info, err := h.broker.Describe(path)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -1,14 +1,62 @@
 package http
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/asim/emque/broker"
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/metrics"
+	"github.com/asim/emque/namespace"
+	"github.com/asim/emque/server"
+	"github.com/asim/emque/trace"
+	"github.com/asim/emque/webhook"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// FormatHeader is set on websocket upgrades when
+	// messages are sent as JSON rather than raw payloads
+	FormatHeader = "X-Emque-Format"
+)
+
+var (
+	// DefaultMaxBodySize is the max size of request bodies published
+	DefaultMaxBodySize int64 = 4 << 20
+
+	// heartbeat interval for streaming subscribers
+	heartbeat = time.Second * 15
+
+	// returned reading a body over the max size
+	errTooLarge = errors.New("request body too large")
+)
+
+// Handler serves the MQ, admin, health and metrics
+// endpoints for a broker. It can be mounted on any mux.
+type Handler struct {
+	broker  broker.Broker
+	options HandlerOptions
+	handler http.Handler
+	started time.Time
+	// webhooks subscribed to the broker
+	hooks *webhook.Manager
+	// closed on Close
+	exit chan bool
+	once sync.Once
+	// websocket subscriptions
+	wg sync.WaitGroup
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -17,14 +65,76 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-func pub(w http.ResponseWriter, r *http.Request) {
+// headers returns the trace context headers of the request
+func headers(r *http.Request) map[string]string {
+	md := make(map[string]string)
+	for _, k := range []string{trace.TraceparentHeader, trace.TracestateHeader} {
+		if v := r.Header.Get(k); len(v) > 0 {
+			md[k] = v
+		}
+	}
+	return md
+}
+
+// code returns the status code of the error
+func code(err error) int {
+	switch {
+	case errors.Is(err, namespace.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, namespace.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, namespace.ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, broker.ErrInvalidTopic):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// deliver writes the message within a delivery span
+func deliver(t trace.Tracer, transport string, wr writer, m *broker.Message) error {
+	ctx := trace.ExtractContext(context.Background(), m.Headers)
+	_, span := t.Start(ctx, "deliver")
+	defer span.End()
+
+	span.SetAttribute("topic", m.Topic)
+	span.SetAttribute("transport", transport)
+
+	err := wr.Write(m)
+	span.SetError(err)
+	return err
+}
+
+// read reads the request body up to the max body size
+func (h *Handler) read(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	max := h.options.MaxBodySize
+	if r.ContentLength > max {
+		return nil, errTooLarge
+	}
+
+	defer r.Body.Close()
+
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, max))
+	// the reader fails once the max is read
+	if err != nil && int64(len(b)) >= max {
+		return nil, errTooLarge
+	}
+	return b, err
+}
+
+func (h *Handler) pub(w http.ResponseWriter, r *http.Request) {
 	topic := r.URL.Query().Get("topic")
+	opts := []broker.PublishOption{
+		broker.Headers(headers(r)),
+		broker.Context(r.Context()),
+	}
 
 	if websocket.IsWebSocketUpgrade(r) {
 		conn, err := upgrader.Upgrade(w, r, w.Header())
 		if err != nil {
 			return
 		}
+		conn.SetReadLimit(h.options.MaxBodySize)
 		for {
 			messageType, b, err := conn.ReadMessage()
 			if messageType == -1 {
@@ -33,58 +143,393 @@ func pub(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				continue
 			}
-			broker.Publish(topic, b)
+			if err := h.broker.Publish(topic, b, opts...); err != nil {
+				logger.FromContext(r.Context()).Error("Failed to publish", "topic", topic, "error", err)
+			}
 		}
 	} else {
-		b, err := ioutil.ReadAll(r.Body)
-		if err != nil {
+		b, err := h.read(w, r)
+		if err == errTooLarge {
+			http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
 			http.Error(w, "Pub error", http.StatusInternalServerError)
 			return
 		}
-		r.Body.Close()
-		if err := broker.Publish(topic, b); err != nil {
-			http.Error(w, "Pub error", http.StatusInternalServerError)
+		if err := h.broker.Publish(topic, b, opts...); err != nil {
+			logger.FromContext(r.Context()).Error("Failed to publish", "topic", topic, "error", err)
+			http.Error(w, fmt.Sprintf("Pub error: %v", err), code(err))
+		}
+	}
+}
+
+// batch publishes a JSON batch of messages returning the error of each
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Messages []*broker.Message `json:"messages"`
+	}
+
+	b, err := h.read(w, r)
+	if err == errTooLarge {
+		http.Error(w, "Batch too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, "Batch error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.Unmarshal(b, &req); err != nil {
+		http.Error(w, "Invalid batch", http.StatusBadRequest)
+		return
+	}
+
+	hdr := headers(r)
+	errs := make([]string, len(req.Messages))
+
+	for i, m := range req.Messages {
+		if len(m.Topic) == 0 {
+			errs[i] = "topic not specified"
+			continue
+		}
+
+		md := m.Headers
+		if len(md) == 0 {
+			md = hdr
+		}
+
+		if err := h.broker.Publish(m.Topic, m.Payload,
+			broker.Headers(md),
+			broker.Context(r.Context()),
+		); err != nil {
+			logger.FromContext(r.Context()).Error("Failed to publish", "topic", m.Topic, "error", err)
+			errs[i] = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": errs,
+	})
+}
+
+func (h *Handler) fetch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	topic := q.Get("topic")
+
+	if len(topic) == 0 {
+		http.Error(w, "Topic not specified", http.StatusBadRequest)
+		return
+	}
+
+	opts := []broker.FetchOption{
+		broker.FetchContext(r.Context()),
+	}
+
+	if group := q.Get("group"); len(group) > 0 {
+		opts = append(opts, broker.Group(group))
+	}
+
+	if v := q.Get("max"); len(v) > 0 {
+		max, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid max", http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, broker.Max(max))
+	}
+
+	if v := q.Get("wait"); len(v) > 0 {
+		wait, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "Invalid wait", http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, broker.Wait(wait))
+	}
+
+	msgs, err := h.broker.Fetch(topic, opts...)
+	if err != nil {
+		logger.FromContext(r.Context()).Error("Failed to fetch", "topic", topic, "error", err)
+		http.Error(w, fmt.Sprintf("Fetch error: %v", err), code(err))
+		return
+	}
+
+	if msgs == nil {
+		msgs = []*broker.Message{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": msgs,
+	})
+}
+
+// offset returns the offset to replay from
+func offset(r *http.Request) (int64, error) {
+	if v := r.URL.Query().Get("offset"); len(v) > 0 {
+		return strconv.ParseInt(v, 10, 64)
+	}
+
+	// resume server-sent events after the last event
+	if v := r.Header.Get("Last-Event-ID"); len(v) > 0 {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, err
 		}
+		return id + 1, nil
 	}
+
+	return 0, nil
 }
 
-func sub(w http.ResponseWriter, r *http.Request) {
+// accepts returns true if the format was requested by query or accept header
+func accepts(r *http.Request, format, contentType string) bool {
+	return r.URL.Query().Get("format") == format || strings.Contains(r.Header.Get("Accept"), contentType)
+}
+
+// shutdown returns true if the handler or broker is shutting down
+func (h *Handler) shutdown() bool {
+	select {
+	case <-h.exit:
+		return true
+	default:
+	}
+	return h.broker.Ready() != nil
+}
+
+// sub handles subscriptions. Subscriptions ended by the broker
+// after Close are told the server is going away. Websockets are
+// tracked by the wait group since the http server does not.
+func (h *Handler) sub(w http.ResponseWriter, r *http.Request) {
 	var wr writer
+	var transport string
+	// closed when the websocket is closed by the client
+	var closed chan bool
 
-	if websocket.IsWebSocketUpgrade(r) {
+	topic := r.URL.Query().Get("topic")
+
+	id, err := offset(r)
+	if err != nil {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case websocket.IsWebSocketUpgrade(r):
+		// send messages as JSON including the id and headers
+		encode := r.URL.Query().Get("format") == "json"
+		if encode {
+			w.Header().Set(FormatHeader, "json")
+		}
+		// added before the connection is hijacked
+		h.wg.Add(1)
+		defer h.wg.Done()
 		conn, err := upgrader.Upgrade(w, r, w.Header())
 		if err != nil {
 			return
 		}
 		// Drain the websocket so that we handle pings and connection close
+		closed = make(chan bool)
 		go func(c *websocket.Conn) {
 			for {
 				if _, _, err := c.NextReader(); err != nil {
 					c.Close()
+					close(closed)
 					break
 				}
 			}
 		}(conn)
-		wr = &wsWriter{conn}
-	} else {
+		wr = &wsWriter{conn: conn, json: encode}
+		transport = "websocket"
+	case accepts(r, "sse", "text/event-stream"):
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		wr = &sseWriter{w}
+		transport = "sse"
+	case accepts(r, "ndjson", "application/x-ndjson"):
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		wr = &ndjsonWriter{w}
+		transport = "ndjson"
+	case r.URL.Query().Get("format") == "length":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		wr = &lengthWriter{w}
+		transport = "length"
+	default:
 		wr = &httpWriter{w}
+		transport = "http"
 	}
 
-	topic := r.URL.Query().Get("topic")
+	// close the connection when done
+	if c, ok := wr.(io.Closer); ok {
+		defer c.Close()
+	}
 
-	ch, err := broker.Subscribe(topic)
+	ch, err := h.broker.SubscribeMessages(topic, broker.Offset(id), broker.Metadata(map[string]string{
+		"remote":    r.RemoteAddr,
+		"transport": transport,
+	}))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Could not retrieve events: %v", err), http.StatusInternalServerError)
+		logger.FromContext(r.Context()).Error("Failed to subscribe", "topic", topic, "error", err)
+		// the websocket is hijacked so the error goes in the close frame
+		if ws, ok := wr.(*wsWriter); ok {
+			ws.code, ws.reason = closeCode(code(err)), err.Error()
+			return
+		}
+		http.Error(w, fmt.Sprintf("Could not retrieve events: %v", err), code(err))
 		return
 	}
-	defer broker.Unsubscribe(topic, ch)
+	defer h.broker.UnsubscribeMessages(topic, ch)
+
+	// send headers to streaming clients
+	if _, ok := wr.(*wsWriter); !ok {
+		w.WriteHeader(http.StatusOK)
+		flush(w)
+	}
+
+	tick := time.NewTicker(heartbeat)
+	defer tick.Stop()
 
 	for {
 		select {
-		case e := <-ch:
-			if err = wr.Write(e); err != nil {
+		case e, ok := <-ch:
+			// unsubscribed
+			if !ok {
+				if ws, ok := wr.(*wsWriter); ok {
+					ws.reason = "unsubscribed"
+					if h.shutdown() {
+						ws.code, ws.reason = websocket.CloseGoingAway, "server shutting down"
+					}
+				}
 				return
 			}
+			if err = deliver(h.options.Tracer, transport, wr, e); err != nil {
+				return
+			}
+		case <-tick.C:
+			if hb, ok := wr.(heartbeater); ok {
+				if err := hb.Heartbeat(); err != nil {
+					return
+				}
+			}
+		case <-r.Context().Done():
+			return
+		case <-closed:
+			return
 		}
 	}
 }
+
+// routes registers the handlers on the mux under the prefix
+func (h *Handler) routes(mux *http.ServeMux) {
+	p := h.options.Prefix
+
+	// MQ Handlers
+	mux.HandleFunc(p+"/pub", h.pub)
+	mux.HandleFunc(p+"/batch", h.batch)
+	mux.HandleFunc(p+"/sub", h.sub)
+	mux.HandleFunc(p+"/fetch", h.fetch)
+
+	// Health Handlers
+	mux.HandleFunc(p+"/healthz", h.healthz)
+	mux.HandleFunc(p+"/readyz", h.readyz)
+
+	// Admin Handlers
+	mux.HandleFunc(p+"/admin/v1/config", h.admin(h.config))
+	mux.HandleFunc(p+"/admin/v1/topics", h.admin(h.topics))
+	mux.HandleFunc(p+"/admin/v1/topics/", h.admin(h.topics))
+	mux.HandleFunc(p+"/admin/v1/webhooks", h.admin(h.webhooks))
+	mux.HandleFunc(p+"/admin/v1/webhooks/", h.admin(h.webhooks))
+
+	// Metrics
+	if ns := h.options.Namespace; len(ns) > 0 {
+		mux.Handle(p+"/metrics", metrics.LabelHandler("namespace", ns))
+	} else {
+		mux.Handle(p+"/metrics", metrics.Handler())
+	}
+
+	// Web Dashboard
+	mux.Handle(p+"/ui/", dashboard(p))
+	mux.Handle(p+"/ui", http.RedirectHandler(p+"/ui/", http.StatusMovedPermanently))
+}
+
+// ServeHTTP serves the handlers
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r)
+}
+
+// Close tells subscriptions the server is going away and waits
+// for websocket subscriptions to be closed by the broker
+func (h *Handler) Close() error {
+	h.once.Do(func() {
+		close(h.exit)
+		h.hooks.Close()
+	})
+	h.wg.Wait()
+	return nil
+}
+
+// NewHandler returns a Handler for the broker
+func NewHandler(b broker.Broker, opts ...HandlerOption) *Handler {
+	var options HandlerOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if options.Tracer == nil {
+		options.Tracer = trace.Default
+	}
+
+	if options.Logger == nil {
+		options.Logger = logger.Default
+	}
+
+	if options.Server == nil {
+		options.Server = new(server.Options)
+	}
+
+	if options.MaxBodySize <= 0 {
+		options.MaxBodySize = DefaultMaxBodySize
+	}
+
+	// mounted at /{prefix} without a trailing slash
+	if p := strings.Trim(options.Prefix, "/"); len(p) > 0 {
+		options.Prefix = "/" + p
+	} else {
+		options.Prefix = ""
+	}
+
+	wopts := []webhook.Option{
+		webhook.Broker(b),
+		webhook.Logger(options.Logger),
+	}
+	if len(options.Dir) > 0 {
+		wopts = append(wopts, webhook.File(filepath.Join(options.Dir, "webhooks.json")))
+	}
+
+	h := &Handler{
+		broker:  b,
+		options: options,
+		started: time.Now(),
+		hooks:   webhook.New(wopts...),
+		exit:    make(chan bool),
+	}
+
+	mux := http.NewServeMux()
+	h.routes(mux)
+
+	var handler http.Handler = mux
+	for i := len(options.Middleware) - 1; i >= 0; i-- {
+		handler = options.Middleware[i](handler)
+	}
+
+	// logging and metrics handler
+	h.handler = instrument(mux, handler, options.Logger)
+
+	return h
+}
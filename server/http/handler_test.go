@@ -0,0 +1,467 @@
+package http
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asim/emque/broker"
+	"github.com/gorilla/websocket"
+)
+
+func TestHandler(t *testing.T) {
+	a, b := broker.New(), broker.New()
+	defer a.Close()
+	defer b.Close()
+
+	var called int
+	mw := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called++
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	// two handlers for different brokers on one mux
+	mux := http.NewServeMux()
+	mux.Handle("/a/", NewHandler(a, Prefix("/a"), Use(mw), Admins("*")))
+	mux.Handle("/b/", NewHandler(b, Prefix("b/")))
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ch, err := a.SubscribeMessages("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsp, err := http.Post(srv.URL+"/a/pub?topic=foo", "text/plain", strings.NewReader("bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 got %d", rsp.StatusCode)
+	}
+	if called != 1 {
+		t.Fatalf("expected middleware to be called once got %d", called)
+	}
+
+	if m := <-ch; string(m.Payload) != "bar" {
+		t.Fatalf("expected message published to broker a got %s", string(m.Payload))
+	}
+	if _, err := b.Describe("foo"); err == nil {
+		t.Fatal("expected topic not to exist in broker b")
+	}
+
+	// batches return the error publishing each message
+	rsp, err = http.Post(srv.URL+"/a/batch", "application/json", strings.NewReader(
+		`{"messages":[{"topic":"foo","payload":"MQ=="},{"payload":"Mg=="}]}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct {
+		Errors []string `json:"errors"`
+	}
+	err = json.NewDecoder(rsp.Body).Decode(&res)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Errors) != 2 || len(res.Errors[0]) > 0 || len(res.Errors[1]) == 0 {
+		t.Fatalf("expected second message of batch to fail got %v", res.Errors)
+	}
+	if m := <-ch; string(m.Payload) != "1" {
+		t.Fatalf("expected batch published to broker a got %s", string(m.Payload))
+	}
+
+	// the admin API is disabled without admins
+	for url, status := range map[string]int{
+		"/a/admin/v1/topics/bar": http.StatusNotFound,
+		"/b/admin/v1/topics/foo": http.StatusForbidden,
+		"/b/admin/v1/webhooks":   http.StatusForbidden,
+		"/b/admin/v1/config":     http.StatusForbidden,
+	} {
+		rsp, err = http.Get(srv.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if rsp.StatusCode != status {
+			t.Fatalf("%s: expected %d got %d", url, status, rsp.StatusCode)
+		}
+	}
+
+	rsp, err = http.Get(srv.URL + "/a/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 got %d", rsp.StatusCode)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+
+	srv := httptest.NewServer(NewHandler(b))
+	defer srv.Close()
+
+	fetch := func(query string) []int64 {
+		rsp, err := http.Get(srv.URL + "/fetch?topic=foo&" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200 got %d", rsp.StatusCode)
+		}
+		var res struct {
+			Messages []*broker.Message `json:"messages"`
+		}
+		if err := json.NewDecoder(rsp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, m := range res.Messages {
+			ids = append(ids, m.Id)
+		}
+		return ids
+	}
+
+	// not buffered until the topic is fetched
+	b.Publish("foo", []byte("foo"))
+	for _, group := range []string{"a", "b"} {
+		if ids := fetch("group=" + group); len(ids) > 0 {
+			t.Fatalf("expected no messages got %v", ids)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := b.Publish("foo", []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each group continues from its own position
+	for _, tc := range []struct {
+		query string
+		want  []int64
+	}{
+		{"group=a&max=2", []int64{2, 3}},
+		{"group=a&max=2", []int64{4}},
+		{"group=b", []int64{2, 3, 4}},
+		{"group=a", nil},
+	} {
+		if ids := fetch(tc.query); fmt.Sprint(ids) != fmt.Sprint(tc.want) {
+			t.Fatalf("%s: expected %v got %v", tc.query, tc.want, ids)
+		}
+	}
+
+	// wait for new messages
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		b.Publish("foo", []byte("foo"))
+	}()
+
+	if ids := fetch("group=a&wait=1s"); len(ids) != 1 || ids[0] != 5 {
+		t.Fatalf("expected message 5 got %v", ids)
+	}
+
+	rsp, err := http.Get(srv.URL + "/fetch?topic=foo&max=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 got %d", rsp.StatusCode)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	received := make(chan string, 10)
+
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msgs []*broker.Message
+		if err := json.NewDecoder(r.Body).Decode(&msgs); err != nil {
+			t.Error(err)
+		}
+		for _, m := range msgs {
+			received <- string(m.Payload)
+		}
+	}))
+	defer hook.Close()
+
+	a, b := broker.New(), broker.New()
+	defer a.Close()
+	defer b.Close()
+
+	ha, hb := NewHandler(a, Admins("*")), NewHandler(b, Admins("*"))
+	defer hb.Close()
+
+	srv := httptest.NewServer(ha)
+	defer srv.Close()
+
+	rsp, err := http.Post(srv.URL+"/admin/v1/webhooks", "application/json", strings.NewReader(
+		fmt.Sprintf(`{"topic":"foo","url":%q}`, hook.URL),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 got %d", rsp.StatusCode)
+	}
+
+	// webhooks are bound to the broker of the handler
+	if err := b.Publish("foo", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Publish("foo", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case m := <-received:
+		if m != "a" {
+			t.Fatalf("expected message a got %s", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for webhook")
+	}
+
+	if list := hb.hooks.List(); len(list) != 0 {
+		t.Fatalf("expected no webhooks on broker b got %d", len(list))
+	}
+
+	// closing the handler stops delivery
+	ha.Close()
+	if list := ha.hooks.List(); len(list) != 0 {
+		t.Fatalf("expected webhooks to be removed got %d", len(list))
+	}
+	if subs, err := a.Describe("foo"); err != nil || len(subs.Subscribers) != 0 {
+		t.Fatalf("expected no subscribers got %+v %v", subs, err)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+
+	srv := httptest.NewServer(NewHandler(b))
+	defer srv.Close()
+
+	// read returns the payload of the first message in the stream
+	testCases := []struct {
+		format      string
+		accept      string
+		contentType string
+		read        func(r *bufio.Reader) (string, error)
+	}{
+		{
+			format:      "sse",
+			accept:      "text/event-stream",
+			contentType: "text/event-stream",
+			read: func(r *bufio.Reader) (string, error) {
+				var data []string
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return "", err
+					}
+					line = strings.TrimSuffix(line, "\n")
+					if len(line) == 0 {
+						return strings.Join(data, "\n"), nil
+					}
+					if strings.HasPrefix(line, "data: ") {
+						data = append(data, strings.TrimPrefix(line, "data: "))
+					}
+				}
+			},
+		},
+		{
+			format:      "ndjson",
+			accept:      "application/x-ndjson",
+			contentType: "application/x-ndjson",
+			read: func(r *bufio.Reader) (string, error) {
+				line, err := r.ReadBytes('\n')
+				if err != nil {
+					return "", err
+				}
+				var m broker.Message
+				if err := json.Unmarshal(line, &m); err != nil {
+					return "", err
+				}
+				if m.Id == 0 || m.Topic != "foo" {
+					return "", fmt.Errorf("unexpected message %+v", m)
+				}
+				return string(m.Payload), nil
+			},
+		},
+		{
+			format:      "length",
+			contentType: "application/octet-stream",
+			read: func(r *bufio.Reader) (string, error) {
+				var n uint32
+				if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+					return "", err
+				}
+				p := make([]byte, n)
+				if _, err := io.ReadFull(r, p); err != nil {
+					return "", err
+				}
+				return string(p), nil
+			},
+		},
+	}
+
+	subscribers := func() int {
+		info, err := b.Describe("foo")
+		if err != nil {
+			return 0
+		}
+		return len(info.Subscribers)
+	}
+
+	for _, tc := range testCases {
+		// selected by the format and by the accept header if supported
+		accepts := []string{""}
+		if len(tc.accept) > 0 {
+			accepts = append(accepts, tc.accept)
+		}
+
+		for _, accept := range accepts {
+			url := srv.URL + "/sub?topic=foo"
+			if len(accept) == 0 {
+				url += "&format=" + tc.format
+			}
+
+			req, err := http.NewRequest("GET", url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(accept) > 0 {
+				req.Header.Set("Accept", accept)
+			}
+
+			rsp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ct := rsp.Header.Get("Content-Type"); ct != tc.contentType {
+				t.Fatalf("%s: expected content type %s got %s", tc.format, tc.contentType, ct)
+			}
+
+			for i := 0; subscribers() != 1; i++ {
+				if i > 100 {
+					t.Fatalf("%s: subscriber not found", tc.format)
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+
+			if err := b.Publish("foo", []byte("bar\nbaz")); err != nil {
+				t.Fatal(err)
+			}
+
+			p, err := tc.read(bufio.NewReader(rsp.Body))
+			rsp.Body.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", tc.format, err)
+			}
+			if p != "bar\nbaz" {
+				t.Fatalf("%s: expected bar\\nbaz got %q", tc.format, p)
+			}
+
+			// wait for the subscription to end
+			for i := 0; subscribers() != 0; i++ {
+				if i > 100 {
+					t.Fatalf("%s: expected subscription to end", tc.format)
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+		}
+	}
+}
+
+func TestWebsocketError(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+
+	h := NewHandler(b)
+	defer h.Close()
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/sub?topic=../foo"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the error is sent in the close frame
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected policy violation close got %v", err)
+	}
+	if ce := err.(*websocket.CloseError); !strings.Contains(ce.Text, "invalid topic") {
+		t.Fatalf("expected invalid topic reason got %q", ce.Text)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+
+	srv := httptest.NewServer(NewHandler(b, MaxBodySize(64)))
+	defer srv.Close()
+
+	batch := `{"messages":[{"topic":"foo","payload":"MQ=="}]}`
+
+	testCases := []struct {
+		name    string
+		path    string
+		body    string
+		chunked bool
+		status  int
+	}{
+		{"pub", "/pub?topic=foo", "bar", false, http.StatusOK},
+		{"pub max", "/pub?topic=foo", strings.Repeat("a", 64), false, http.StatusOK},
+		{"pub too large", "/pub?topic=foo", strings.Repeat("a", 65), false, http.StatusRequestEntityTooLarge},
+		{"pub chunked too large", "/pub?topic=foo", strings.Repeat("a", 65), true, http.StatusRequestEntityTooLarge},
+		{"batch", "/batch", batch, false, http.StatusOK},
+		{"batch too large", "/batch", strings.Replace(batch, "MQ==", strings.Repeat("MQ==", 10), 1), false, http.StatusRequestEntityTooLarge},
+		{"batch chunked too large", "/batch", strings.Replace(batch, "MQ==", strings.Repeat("MQ==", 10), 1), true, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(tc.body)
+			// unknown content length
+			if tc.chunked {
+				body = io.MultiReader(body)
+			}
+
+			rsp, err := http.Post(srv.URL+tc.path, "text/plain", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsp.Body.Close()
+
+			if rsp.StatusCode != tc.status {
+				t.Fatalf("expected %d got %d", tc.status, rsp.StatusCode)
+			}
+		})
+	}
+}
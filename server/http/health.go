@@ -0,0 +1,22 @@
+package http
+
+import (
+	"net/http"
+)
+
+// healthz reports the server is alive
+func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether the broker is ready to serve requests
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	if err := h.broker.Ready(); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status": "unavailable",
+			"error":  err.Error(),
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
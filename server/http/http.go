@@ -4,60 +4,46 @@ import (
 	"context"
 	"crypto/tls"
 	"net/http"
-	"os"
 
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/logger"
 	"github.com/asim/emque/server"
 	"github.com/asim/emque/server/util"
-	"github.com/gorilla/handlers"
+	"github.com/asim/emque/trace"
 )
 
 type httpServer struct {
 	options *server.Options
-	srv     *http.Server
+	handler interface {
+		http.Handler
+		Close() error
+	}
+	srv *http.Server
 }
 
 func (h *httpServer) Run() error {
-	// MQ Handlers
-	http.HandleFunc("/pub", pub)
-	http.HandleFunc("/sub", sub)
-
-	// logging handler
-	handler := handlers.LoggingHandler(os.Stdout, http.DefaultServeMux)
 	address := h.options.Address
 
-	// tls cert and key specified
-	if h.options.TLS != nil {
-		cert := h.options.TLS.CertFile
-		key := h.options.TLS.KeyFile
-		return http.ListenAndServeTLS(address, cert, key, handler)
-	}
-
-	// generate tls config
-	addr, err := util.Address(address)
-	if err != nil {
-		return err
-	}
-
-	cert, err := util.Certificate(addr)
-	if err != nil {
-		return err
-	}
-
-	config := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"h2", "http/1.1"},
-	}
-
-	l, err := tls.Listen("tcp", address, config)
+	l, err := util.Listen(address)
 	if err != nil {
 		return err
 	}
 	defer l.Close()
 
 	srv := &http.Server{
-		Addr:      address,
-		Handler:   handler,
-		TLSConfig: config,
+		Addr:    address,
+		Handler: h.handler,
+	}
+
+	// tls enabled
+	if !h.options.Insecure && !util.IsUnix(address) {
+		config, err := server.TLSConfig(h.options)
+		if err != nil {
+			return err
+		}
+		config.NextProtos = []string{"h2", "http/1.1"}
+		srv.TLSConfig = config
+		l = tls.NewListener(l, config)
 	}
 
 	h.srv = srv
@@ -65,8 +51,20 @@ func (h *httpServer) Run() error {
 	return srv.Serve(l)
 }
 
+// ServeHTTP serves the MQ handlers
+func (h *httpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r)
+}
+
+// Stop stops accepting connections and waits for requests to complete.
+// Subscriptions complete once closed by the broker.
 func (h *httpServer) Stop() error {
-	return h.srv.Shutdown(context.TODO())
+	var err error
+	if h.srv != nil {
+		err = h.srv.Shutdown(context.TODO())
+	}
+	h.handler.Close()
+	return err
 }
 
 func New(opts ...server.Option) *httpServer {
@@ -74,7 +72,39 @@ func New(opts ...server.Option) *httpServer {
 	for _, o := range opts {
 		o(options)
 	}
-	return &httpServer{
+
+	if options.Tracer == nil {
+		options.Tracer = trace.Default
+	}
+
+	if options.Logger == nil {
+		options.Logger = logger.Default
+	}
+
+	if options.Broker == nil {
+		options.Broker = broker.Default
+	}
+
+	hopts := []HandlerOption{
+		Tracer(options.Tracer),
+		Logger(options.Logger),
+		Config(options),
+		Dir(options.DataDir),
+		Admins(options.Admins...),
+		MaxBodySize(options.MaxBodySize),
+	}
+
+	root := NewHandler(options.Broker, hopts...)
+
+	h := &httpServer{
 		options: options,
+		handler: root,
+	}
+
+	// namespaces served alongside the default
+	if options.Namespaces != nil {
+		h.handler = newNamespaces(options.Namespaces, root, hopts...)
 	}
+
+	return h
 }
@@ -0,0 +1,342 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/client"
+	"github.com/asim/emque/server"
+)
+
+func TestUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mq.sock")
+	addr := "unix://" + path
+
+	b := broker.New()
+	defer b.Close()
+
+	srv := New(server.WithAddress(addr), server.WithBroker(b))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Run()
+	}()
+
+	// wait for the server to listen
+	for i := 0; ; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatal("socket not created")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	c := client.New(client.WithServers(addr), client.WithRetries(0))
+	defer c.Close()
+
+	ch, err := c.Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the subscription before publishing
+	for i := 0; ; i++ {
+		if info, err := b.Describe("foo"); err == nil && len(info.Subscribers) > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("subscriber not found")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if err := c.Publish("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case p := <-ch:
+		if string(p) != "bar" {
+			t.Fatalf("expected bar got %s", string(p))
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for message")
+	}
+
+	// the socket is removed on shutdown
+	b.Close()
+	if err := srv.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	<-errCh
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected socket to be removed got %v", err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mq.sock")
+	addr := "unix://" + path
+
+	b := broker.New()
+
+	srv := New(server.WithAddress(addr), server.WithBroker(b))
+	go srv.Run()
+	defer srv.Stop()
+	defer b.Close()
+
+	for i := 0; ; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatal("socket not created")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// no handler is returned if every server fails
+	uc := client.New(client.WithServers("http://127.0.0.1:1"), client.WithRetries(0), client.WithResubscribe(false))
+	if h, err := uc.(client.HandlerClient).Handle("foo", func(ctx context.Context, m *client.Message) error {
+		return nil
+	}); h != nil || err == nil {
+		t.Fatalf("expected no handler and an error got %v %v", h, err)
+	}
+	uc.Close()
+
+	c := client.New(client.WithServers(addr), client.WithRetries(0))
+	defer c.Close()
+
+	var mtx sync.Mutex
+	attempts := make(map[string][]time.Time)
+	handled := make(chan string, 10)
+
+	h, err := c.(client.HandlerClient).Handle("foo", func(ctx context.Context, m *client.Message) error {
+		p := string(m.Payload)
+
+		mtx.Lock()
+		attempts[p] = append(attempts[p], time.Now())
+		mtx.Unlock()
+
+		switch {
+		case p == "fail":
+			return errors.New("failed")
+		case p == "retry" && m.Attempt == 1:
+			return errors.New("failed")
+		}
+
+		handled <- p
+		return nil
+	},
+		client.MaxAttempts(3),
+		client.HandleBackoff(time.Millisecond*100, time.Millisecond*100),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		if info, err := b.Describe("foo"); err == nil && len(info.Subscribers) > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("subscriber not found")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	for _, p := range []string{"ok", "retry", "fail"} {
+		if err := c.Publish("foo", []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-handled:
+			got[p] = true
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+	if !got["ok"] || !got["retry"] {
+		t.Fatalf("expected ok and retry to be handled got %v", got)
+	}
+
+	// failed messages are dropped after the max attempts
+	for i := 0; ; i++ {
+		mtx.Lock()
+		n := len(attempts["fail"])
+		mtx.Unlock()
+		if n == 3 {
+			break
+		}
+		if i > 500 {
+			t.Fatalf("expected 3 attempts got %d", n)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	mtx.Lock()
+	if n := len(attempts["fail"]); n != 3 {
+		t.Fatalf("expected 3 attempts got %d", n)
+	}
+	// attempts are delivered again after the backoff
+	for p, times := range attempts {
+		for i := 1; i < len(times); i++ {
+			if d := times[i].Sub(times[i-1]); d < time.Millisecond*50 {
+				t.Fatalf("%s: expected backoff between attempts got %v", p, d)
+			}
+		}
+	}
+	mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := h.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProducer(t *testing.T) {
+	b := broker.New()
+	defer b.Close()
+
+	var mtx sync.Mutex
+	requests := make(map[string]int)
+	count := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mtx.Lock()
+			requests[r.URL.Path]++
+			mtx.Unlock()
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	srv := httptest.NewServer(NewHandler(b, Use(count)))
+	defer srv.Close()
+
+	c := client.New(
+		client.WithServers(srv.Listener.Addr().String()),
+		client.WithInsecure(true),
+		client.WithRetries(0),
+	)
+	defer c.Close()
+
+	ch, err := b.SubscribeMessages("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := client.NewProducer(c, client.BatchSize(5), client.FlushInterval(time.Minute))
+
+	var futures []*client.Future
+	for i := 0; i < 12; i++ {
+		futures = append(futures, p.Publish("foo", []byte("foo")))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := p.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range futures {
+		if err := f.Wait(); err != nil {
+			t.Fatalf("message %d failed: %v", i, err)
+		}
+	}
+	for i := 0; i < 12; i++ {
+		select {
+		case <-ch:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	// sent in batches of up to 5
+	mtx.Lock()
+	if requests["/batch"] != 3 || requests["/pub"] != 0 {
+		t.Fatalf("expected 3 batches got %v", requests)
+	}
+	mtx.Unlock()
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProducerTimeout(t *testing.T) {
+	release := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+
+	var once sync.Once
+	unblock := func() {
+		once.Do(func() { close(release) })
+	}
+	defer unblock()
+
+	c := client.New(
+		client.WithServers(srv.Listener.Addr().String()),
+		client.WithInsecure(true),
+		client.WithRetries(0),
+	)
+	defer c.Close()
+
+	// batches time out against an unresponsive server
+	p := client.NewProducer(c, client.BatchSize(1), client.PublishTimeout(time.Millisecond*100))
+	defer p.Close()
+
+	f := p.Publish("foo", []byte("foo"))
+	select {
+	case <-f.Done():
+		if f.Err() == nil {
+			t.Fatal("expected publish to time out")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for publish timeout")
+	}
+
+	// flush returns once its context is done
+	p = client.NewProducer(c, client.BatchSize(1), client.BufferSize(0), client.PublishTimeout(0))
+	p.Publish("foo", []byte("foo"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := p.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded got %v", err)
+	}
+
+	unblock()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package http
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/metrics"
+)
+
+const (
+	// RequestIdHeader identifies a request in logs
+	RequestIdHeader = "X-Request-Id"
+)
+
+var requests = metrics.NewCounter("emque_http_requests_total", "HTTP requests by path, method and status code.", "path", "method", "code")
+
+// statusWriter records the status code written
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	// websocket upgrades
+	w.code = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func requestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// instrument serves next counting requests by the pattern matched in the mux and logs them.
+// Handlers log via the request logger in the context.
+func instrument(mux *http.ServeMux, next http.Handler, log logger.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		_, path := mux.Handler(r)
+		if len(path) == 0 {
+			path = "unmatched"
+		}
+
+		id := r.Header.Get(RequestIdHeader)
+		if len(id) == 0 {
+			id = requestId()
+		}
+		w.Header().Set(RequestIdHeader, id)
+
+		rlog := log.With("request_id", id)
+		r = r.WithContext(logger.NewContext(r.Context(), rlog))
+
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		requests.Inc(path, r.Method, strconv.Itoa(sw.code))
+		rlog.Info("Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"code", sw.code,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,209 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/asim/emque/namespace"
+)
+
+// namespaces serves the handlers of each namespace under /ns/{name}/
+// and the namespace admin API. Requests without a namespace in the
+// path are served by the namespace selected by header or client
+// certificate, falling back to the default namespace.
+type namespaces struct {
+	manager *namespace.Manager
+	// options of every namespace handler
+	options []HandlerOption
+	// handler of the default namespace
+	root  *Handler
+	admin http.Handler
+
+	sync.Mutex
+	handlers map[string]*Handler
+}
+
+// action returns the ACL action of the path within a namespace
+func action(path string) namespace.Action {
+	switch {
+	case path == "/pub", path == "/batch":
+		return namespace.Publish
+	case path == "/sub", path == "/fetch":
+		return namespace.Subscribe
+	case strings.HasPrefix(path, "/admin/"):
+		return namespace.Admin
+	}
+	return ""
+}
+
+// handler returns the handler bound to the broker of the namespace
+func (n *namespaces) handler(name string) (*Handler, error) {
+	b, err := n.manager.Broker(name)
+	if err != nil {
+		return nil, err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	h, ok := n.handlers[name]
+	if ok && h.broker == b {
+		return h, nil
+	}
+
+	// the namespace was deleted and created again
+	if ok {
+		go h.Close()
+	}
+
+	opts := append([]HandlerOption{}, n.options...)
+	opts = append(opts,
+		Prefix("/ns/"+name),
+		Logger(n.root.options.Logger.With("namespace", name)),
+		Namespace(name),
+	)
+	// saved with the namespace topics
+	if len(n.root.options.Dir) > 0 {
+		opts = append(opts, Dir(n.manager.Dir(name)))
+	}
+	h = NewHandler(b, opts...)
+	n.handlers[name] = h
+	return h, nil
+}
+
+func (n *namespaces) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+
+	identity := namespace.Identity(r.TLS)
+
+	if path == "/admin/v1/namespaces" || strings.HasPrefix(path, "/admin/v1/namespaces/") {
+		if err := n.manager.AllowAdmin(identity); err != nil {
+			writeError(w, code(err), err.Error())
+			return
+		}
+		n.admin.ServeHTTP(w, r)
+		return
+	}
+	name := r.Header.Get(namespace.Header)
+
+	// selected by path
+	if strings.HasPrefix(path, "/ns/") {
+		rest := strings.TrimPrefix(path, "/ns/")
+		i := strings.Index(rest, "/")
+		if i < 0 {
+			http.Redirect(w, r, path+"/ui/", http.StatusFound)
+			return
+		}
+		name, path = rest[:i], rest[i:]
+	}
+
+	name = n.manager.Resolve(name, identity)
+
+	if a := action(path); len(a) > 0 {
+		if err := n.manager.Allow(name, identity, a); err != nil {
+			writeError(w, code(err), err.Error())
+			return
+		}
+	}
+
+	if name == namespace.DefaultName && path == r.URL.Path {
+		n.root.ServeHTTP(w, r)
+		return
+	}
+
+	h, err := n.handler(name)
+	if err != nil {
+		writeError(w, code(err), err.Error())
+		return
+	}
+
+	// selected by header or identity
+	if path == r.URL.Path {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/ns/" + name + path
+		r2.URL.RawPath = ""
+		r = r2
+	}
+
+	h.ServeHTTP(w, r)
+}
+
+// namespaces handles /admin/v1/namespaces and /admin/v1/namespaces/{name}
+func (n *namespaces) namespaces(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/v1/namespaces"), "/")
+
+	switch {
+	case len(name) == 0 && r.Method == "GET":
+		writeJSON(w, http.StatusOK, n.manager.List())
+	case len(name) == 0 && r.Method == "POST":
+		ns := new(namespace.Namespace)
+		if err := json.NewDecoder(r.Body).Decode(ns); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := n.manager.Create(ns); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, ns)
+	case len(name) > 0 && r.Method == "GET":
+		ns, err := n.manager.Get(name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, ns)
+	case len(name) > 0 && r.Method == "DELETE":
+		if err := n.manager.Delete(name); err != nil {
+			writeError(w, code(err), err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// Close closes the handlers of every namespace
+func (n *namespaces) Close() error {
+	handlers := []*Handler{n.root}
+
+	n.Lock()
+	for _, h := range n.handlers {
+		handlers = append(handlers, h)
+	}
+	n.Unlock()
+
+	var wg sync.WaitGroup
+	for _, h := range handlers {
+		wg.Add(1)
+		go func(h *Handler) {
+			defer wg.Done()
+			h.Close()
+		}(h)
+	}
+	wg.Wait()
+	return nil
+}
+
+func newNamespaces(m *namespace.Manager, root *Handler, opts ...HandlerOption) *namespaces {
+	n := &namespaces{
+		manager:  m,
+		options:  opts,
+		root:     root,
+		handlers: make(map[string]*Handler),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/v1/namespaces", n.namespaces)
+	mux.HandleFunc("/admin/v1/namespaces/", n.namespaces)
+	n.admin = instrument(mux, mux, root.options.Logger)
+
+	return n
+}
@@ -0,0 +1,168 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/namespace"
+)
+
+func TestNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	def := broker.New()
+	defer def.Close()
+
+	m, err := namespace.New(namespace.Broker(def), namespace.Dir(dir), namespace.Admins("ops"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	n := newNamespaces(m, NewHandler(def, Admins("ops")), Admins("ops"))
+	defer n.Close()
+
+	srv := httptest.NewServer(n)
+	defer srv.Close()
+
+	do := func(method, path string, body string, hdr map[string]string) int {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	// requests as the identity of a verified client certificate
+	serve := func(method, path string, body string, identity string) *httptest.ResponseRecorder {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: identity}}
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+		w := httptest.NewRecorder()
+		n.ServeHTTP(w, r)
+		return w
+	}
+	admin := func(method, path string, body string, identity string) int {
+		return serve(method, path, body, identity).Code
+	}
+
+	// only admins manage namespaces
+	create := `{"name":"team","quota":{"max_message_size":3}}`
+	if c := do("POST", "/admin/v1/namespaces", create, nil); c != http.StatusForbidden {
+		t.Fatalf("expected 403 got %d", c)
+	}
+	if c := admin("POST", "/admin/v1/namespaces", create, "team"); c != http.StatusForbidden {
+		t.Fatalf("expected 403 got %d", c)
+	}
+	if c := admin("POST", "/admin/v1/namespaces", create, "ops"); c != http.StatusCreated {
+		t.Fatalf("expected 201 got %d", c)
+	}
+
+	b, err := m.Broker("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := b.Subscribe("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// selected by path then header
+	if c := do("POST", "/ns/team/pub?topic=foo", "a", nil); c != http.StatusOK {
+		t.Fatalf("expected 200 got %d", c)
+	}
+	if c := do("POST", "/pub?topic=foo", "b", map[string]string{namespace.Header: "team"}); c != http.StatusOK {
+		t.Fatalf("expected 200 got %d", c)
+	}
+	for _, want := range []string{"a", "b"} {
+		if msg := <-ch; string(msg) != want {
+			t.Fatalf("expected %s got %s", want, string(msg))
+		}
+	}
+
+	if c := do("POST", "/ns/team/pub?topic=foo", "toolong", nil); c != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 got %d", c)
+	}
+	// topics may not escape the namespace directory
+	if c := do("POST", "/ns/team/pub?topic=../default/foo", "a", nil); c != http.StatusBadRequest {
+		t.Fatalf("expected 400 got %d", c)
+	}
+	if c := do("GET", "/ns/team/fetch?topic=..%5Cfoo", "", nil); c != http.StatusBadRequest {
+		t.Fatalf("expected 400 got %d", c)
+	}
+	if c := do("POST", "/ns/missing/pub?topic=foo", "a", nil); c != http.StatusNotFound {
+		t.Fatalf("expected 404 got %d", c)
+	}
+
+	// metrics of other namespaces are not served
+	if err := def.Publish("bar", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.Get(srv.URL + "/ns/team/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `emque_messages_published_total{namespace="team",topic="foo"} 2`) {
+		t.Fatalf("expected metrics of namespace team got\n%s", body)
+	}
+	if strings.Contains(string(body), `topic="bar"`) || strings.Contains(string(body), "emque_http_requests_total") {
+		t.Fatalf("expected only metrics of namespace team got\n%s", body)
+	}
+
+	// the admin API lists the topics of the namespace to admins
+	for _, path := range []string{"/ns/team/admin/v1/topics", "/ns/team/admin/v1/webhooks", "/admin/v1/config"} {
+		if c := do("GET", path, "", nil); c != http.StatusForbidden {
+			t.Fatalf("%s: expected 403 got %d", path, c)
+		}
+	}
+	w := serve("GET", "/ns/team/admin/v1/topics", "", "ops")
+	var topics []*broker.Topic
+	if err := json.NewDecoder(w.Body).Decode(&topics); err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 1 || topics[0].Name != "foo" {
+		t.Fatalf("expected topic foo got %+v", topics)
+	}
+
+	if c := do("DELETE", "/admin/v1/namespaces/team", "", nil); c != http.StatusForbidden {
+		t.Fatalf("expected 403 got %d", c)
+	}
+	if c := do("GET", "/admin/v1/namespaces", "", nil); c != http.StatusForbidden {
+		t.Fatalf("expected 403 got %d", c)
+	}
+	if c := admin("DELETE", "/admin/v1/namespaces/team", "", "ops"); c != http.StatusNoContent {
+		t.Fatalf("expected 204 got %d", c)
+	}
+	if c := do("POST", "/ns/team/pub?topic=foo", "a", nil); c != http.StatusNotFound {
+		t.Fatalf("expected 404 got %d", c)
+	}
+}
@@ -0,0 +1,100 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/server"
+	"github.com/asim/emque/trace"
+)
+
+// Middleware wraps the handler e.g for authentication
+type Middleware func(http.Handler) http.Handler
+
+type HandlerOptions struct {
+	// Prefix the handlers are mounted at e.g /mq
+	Prefix string
+	// Middleware applied in order, the first being outermost
+	Middleware []Middleware
+	Tracer     trace.Tracer
+	Logger     logger.Logger
+	// Server options reported by /admin/v1/config
+	Server *server.Options
+	// Directory webhooks are saved in
+	Dir string
+	// Identities allowed to use the admin API
+	Admins []string
+	// Namespace served, limits the metrics to its series
+	Namespace string
+	// Max size in bytes of request bodies published
+	MaxBodySize int64
+}
+
+type HandlerOption func(o *HandlerOptions)
+
+// Prefix sets the path prefix the handlers are mounted at
+func Prefix(p string) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.Prefix = p
+	}
+}
+
+// Use appends middleware wrapping the handlers
+func Use(m ...Middleware) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.Middleware = append(o.Middleware, m...)
+	}
+}
+
+// Tracer sets the tracer used for delivery spans
+func Tracer(t trace.Tracer) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.Tracer = t
+	}
+}
+
+// Logger sets the request logger
+func Logger(l logger.Logger) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.Logger = l
+	}
+}
+
+// Dir sets the directory webhooks are saved in. Webhooks
+// are held in memory if not set.
+func Dir(d string) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.Dir = d
+	}
+}
+
+// Admins sets the client certificate identities allowed to use the
+// admin API, * allows anyone. The admin API is disabled if not set.
+func Admins(ids ...string) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.Admins = ids
+	}
+}
+
+// Namespace sets the namespace served. Only the metrics
+// of the namespace are served by /metrics.
+func Namespace(name string) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.Namespace = name
+	}
+}
+
+// MaxBodySize limits the size in bytes of request bodies published
+// to /pub and /batch. Larger bodies are rejected with 413.
+func MaxBodySize(n int64) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.MaxBodySize = n
+	}
+}
+
+// Config sets the server options reported by /admin/v1/config
+func Config(opts *server.Options) HandlerOption {
+	return func(o *HandlerOptions) {
+		o.Server = opts
+	}
+}
@@ -0,0 +1,19 @@
+package http
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var ui embed.FS
+
+// dashboard serves the embedded web dashboard under the prefix
+func dashboard(prefix string) http.Handler {
+	sub, err := fs.Sub(ui, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix(prefix+"/ui/", http.FileServer(http.FS(sub)))
+}
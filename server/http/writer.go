@@ -1,33 +1,143 @@
 package http
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/asim/emque/broker"
 	"github.com/gorilla/websocket"
 )
 
 type writer interface {
-	Write(b []byte) error
+	Write(m *broker.Message) error
 }
 
+// heartbeater is a writer which keeps idle connections alive
+type heartbeater interface {
+	Heartbeat() error
+}
+
+// httpWriter writes raw payloads
 type httpWriter struct {
 	w http.ResponseWriter
 }
 
+// sseWriter writes server-sent events
+type sseWriter struct {
+	w http.ResponseWriter
+}
+
+// ndjsonWriter writes a JSON message per line
+type ndjsonWriter struct {
+	w http.ResponseWriter
+}
+
+// lengthWriter writes payloads prefixed by their 4 byte big endian length
+type lengthWriter struct {
+	w http.ResponseWriter
+}
+
 type wsWriter struct {
 	conn *websocket.Conn
+	// write JSON messages rather than payloads
+	json bool
+	// close code and reason sent to the client
+	code   int
+	reason string
 }
 
-func (w *httpWriter) Write(b []byte) error {
-	if _, err := w.w.Write(b); err != nil {
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *httpWriter) Write(m *broker.Message) error {
+	if _, err := w.w.Write(m.Payload); err != nil {
 		return err
 	}
-	if f, ok := w.w.(http.Flusher); ok {
-		f.Flush()
+	flush(w.w)
+	return nil
+}
+
+func (w *sseWriter) Write(m *broker.Message) error {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "id: %d\n", m.Id)
+	for _, line := range bytes.Split(m.Payload, []byte{'\n'}) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	if _, err := w.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	flush(w.w)
+	return nil
+}
+
+func (w *sseWriter) Heartbeat() error {
+	if _, err := w.w.Write([]byte(": heartbeat\n\n")); err != nil {
+		return err
+	}
+	flush(w.w)
+	return nil
+}
+
+func (w *ndjsonWriter) Write(m *broker.Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	flush(w.w)
+	return nil
+}
+
+func (w *lengthWriter) Write(m *broker.Message) error {
+	b := make([]byte, 4+len(m.Payload))
+	binary.BigEndian.PutUint32(b, uint32(len(m.Payload)))
+	copy(b[4:], m.Payload)
+	if _, err := w.w.Write(b); err != nil {
+		return err
 	}
+	flush(w.w)
 	return nil
 }
 
-func (w *wsWriter) Write(b []byte) error {
-	return w.conn.WriteMessage(websocket.BinaryMessage, b)
+func (w *wsWriter) Write(m *broker.Message) error {
+	if w.json {
+		return w.conn.WriteJSON(m)
+	}
+	return w.conn.WriteMessage(websocket.BinaryMessage, m.Payload)
+}
+
+// closeCode maps a http status to a websocket close code
+func closeCode(status int) int {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return websocket.CloseTryAgainLater
+	case status >= 500:
+		return websocket.CloseInternalServerErr
+	default:
+		return websocket.ClosePolicyViolation
+	}
+}
+
+// Close sends a close frame and closes the connection
+func (w *wsWriter) Close() error {
+	code := w.code
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+	}
+	msg := websocket.FormatCloseMessage(code, w.reason)
+	w.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return w.conn.Close()
 }
@@ -0,0 +1,110 @@
+// Package mux serves HTTP and gRPC on the same address
+package mux
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"github.com/asim/emque/server"
+	grpcsrv "github.com/asim/emque/server/grpc"
+	httpsrv "github.com/asim/emque/server/http"
+	"github.com/asim/emque/server/util"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+type muxServer struct {
+	options *server.Options
+	grpc    server.Server
+	http    server.Server
+	handler http.Handler
+	srv     *http.Server
+}
+
+// handler routes gRPC requests based on the content type
+func handler(grpc, http1 http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpc.ServeHTTP(w, r)
+			return
+		}
+		http1.ServeHTTP(w, r)
+	})
+}
+
+func (m *muxServer) Run() error {
+	address := m.options.Address
+
+	l, err := util.Listen(address)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	srv := &http.Server{
+		Addr:    address,
+		Handler: m.handler,
+	}
+
+	if !m.options.Insecure && !util.IsUnix(address) {
+		// tls enabled, gRPC is negotiated as h2 via ALPN
+		config, err := server.TLSConfig(m.options)
+		if err != nil {
+			return err
+		}
+		config.NextProtos = []string{"h2", "http/1.1"}
+		srv.TLSConfig = config
+		l = tls.NewListener(l, config)
+	} else {
+		// plaintext gRPC requires h2c
+		srv.Handler = h2c.NewHandler(m.handler, new(http2.Server))
+	}
+
+	m.srv = srv
+
+	return srv.Serve(l)
+}
+
+// Stop stops accepting connections while gRPC streams drain
+func (m *muxServer) Stop() error {
+	errCh := make(chan error, 2)
+
+	go func() {
+		errCh <- m.grpc.Stop()
+	}()
+	go func() {
+		errCh <- m.http.Stop()
+	}()
+
+	var err error
+	if m.srv != nil {
+		err = m.srv.Shutdown(context.TODO())
+	}
+
+	for i := 0; i < 2; i++ {
+		if gerr := <-errCh; err == nil {
+			err = gerr
+		}
+	}
+	return err
+}
+
+// New returns a server which serves HTTP and gRPC on the same address
+func New(opts ...server.Option) *muxServer {
+	options := new(server.Options)
+	for _, o := range opts {
+		o(options)
+	}
+
+	g := grpcsrv.New(opts...)
+	h := httpsrv.New(opts...)
+
+	return &muxServer{
+		options: options,
+		grpc:    g,
+		http:    h,
+		handler: handler(g, h),
+	}
+}
@@ -0,0 +1,121 @@
+package mux
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/asim/emque/broker"
+	mq "github.com/asim/emque/proto"
+	"github.com/asim/emque/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// address returns a free local address
+func address(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestMux(t *testing.T) {
+	testCases := []struct {
+		name     string
+		insecure bool
+	}{
+		{name: "tls"},
+		{name: "h2c", insecure: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := address(t)
+
+			b := broker.New()
+
+			srv := New(
+				server.WithAddress(addr),
+				server.WithInsecure(tc.insecure),
+				server.WithBroker(b),
+			)
+			go srv.Run()
+			defer srv.Stop()
+			defer b.Close()
+
+			scheme := "http"
+			dopt := grpc.WithInsecure()
+			hc := new(http.Client)
+
+			if !tc.insecure {
+				// gRPC is negotiated as h2 via ALPN
+				config := &tls.Config{InsecureSkipVerify: true}
+				scheme = "https"
+				dopt = grpc.WithTransportCredentials(credentials.NewTLS(config))
+				hc.Transport = &http.Transport{TLSClientConfig: config}
+			}
+
+			// wait for the server to listen
+			var err error
+			for i := 0; i < 100; i++ {
+				var rsp *http.Response
+				if rsp, err = hc.Get(scheme + "://" + addr + "/healthz"); err == nil {
+					rsp.Body.Close()
+					if rsp.StatusCode != http.StatusOK {
+						t.Fatalf("expected 200 got %d", rsp.StatusCode)
+					}
+					break
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := grpc.Dial(addr, dopt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+
+			// serving once the broker is ready
+			for i := 0; ; i++ {
+				rsp, err := healthpb.NewHealthClient(conn).Check(ctx, new(healthpb.HealthCheckRequest))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rsp.Status == healthpb.HealthCheckResponse_SERVING {
+					break
+				}
+				if i > 100 {
+					t.Fatalf("expected serving got %v", rsp.Status)
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+
+			// published over gRPC and fetched over HTTP
+			if _, err := mq.NewMQClient(conn).Pub(ctx, &mq.PubRequest{Topic: "foo", Payload: []byte("bar")}); err != nil {
+				t.Fatal(err)
+			}
+
+			frsp, err := hc.Get(scheme + "://" + addr + "/fetch?topic=foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			frsp.Body.Close()
+			if frsp.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200 got %d", frsp.StatusCode)
+			}
+		})
+	}
+}
@@ -1,8 +1,59 @@
 package server
 
+import (
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/namespace"
+	"github.com/asim/emque/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
 type Options struct {
-	Address string
-	TLS     *TLS
+	Address    string
+	TLS        *TLS
+	ClientAuth *ClientAuth
+	// Directory used to persist a generated
+	// CA and certificate across restarts
+	CertDir string
+	// Directory webhooks are saved in. Webhooks
+	// are held in memory if empty.
+	DataDir string
+	// Serve plaintext rather than TLS
+	Insecure bool
+	// Tracer records delivery spans
+	Tracer trace.Tracer
+	// Logger for requests and server events
+	Logger logger.Logger
+	// Broker served, defaults to broker.Default
+	Broker broker.Broker
+	// Namespaces served in addition to the broker
+	// which is served as the default namespace
+	Namespaces *namespace.Manager
+	// Client certificate identities allowed to use
+	// the admin API, disabled if empty
+	Admins []string
+	// Max size in bytes of request bodies published
+	// over HTTP, defaults to 4MB
+	MaxBodySize int64
+	// GRPC configures the gRPC server
+	GRPC GRPC
+}
+
+// GRPC configures the gRPC server
+type GRPC struct {
+	// Interceptors run in order after the built in
+	// metrics, logging and panic recovery interceptors
+	UnaryInterceptors  []grpc.UnaryServerInterceptor
+	StreamInterceptors []grpc.StreamServerInterceptor
+	// Register the reflection service used by tools like grpcurl
+	Reflection bool
+	// Keepalive pings sent to clients and connection ages
+	Keepalive *keepalive.ServerParameters
+	// KeepalivePolicy enforced on client pings
+	KeepalivePolicy *keepalive.EnforcementPolicy
+	// Max concurrent streams per connection, zero is unlimited
+	MaxConcurrentStreams uint32
 }
 
 type TLS struct {
@@ -10,6 +61,14 @@ type TLS struct {
 	KeyFile  string
 }
 
+// ClientAuth verifies client certificates against a CA
+type ClientAuth struct {
+	CAFile string
+	// Require a client certificate rather
+	// than only verifying one if presented
+	Require bool
+}
+
 type Option func(o *Options)
 
 func WithAddress(addr string) Option {
@@ -26,3 +85,123 @@ func WithTLS(certFile, keyFile string) Option {
 		}
 	}
 }
+
+// WithInsecure serves plaintext rather than TLS. Unix
+// domain sockets are always served in plaintext.
+func WithInsecure(b bool) Option {
+	return func(o *Options) {
+		o.Insecure = b
+	}
+}
+
+// WithCertDir persists a generated CA and certificate to dir
+// so they are reused across restarts and can be pinned by clients
+func WithCertDir(dir string) Option {
+	return func(o *Options) {
+		o.CertDir = dir
+	}
+}
+
+// WithDataDir saves webhooks to dir so they are registered again on restart
+func WithDataDir(dir string) Option {
+	return func(o *Options) {
+		o.DataDir = dir
+	}
+}
+
+// WithAdmins allows the client certificate identities to use
+// the admin API. Use * to allow anyone e.g without TLS.
+func WithAdmins(ids ...string) Option {
+	return func(o *Options) {
+		o.Admins = ids
+	}
+}
+
+// WithMaxBodySize limits the size of request bodies published over HTTP
+func WithMaxBodySize(n int64) Option {
+	return func(o *Options) {
+		o.MaxBodySize = n
+	}
+}
+
+// WithClientAuth verifies client certificates against the CA
+func WithClientAuth(caFile string, require bool) Option {
+	return func(o *Options) {
+		o.ClientAuth = &ClientAuth{
+			CAFile:  caFile,
+			Require: require,
+		}
+	}
+}
+
+// WithTracer sets the tracer used to record spans
+func WithTracer(t trace.Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = t
+	}
+}
+
+// WithLogger sets the logger
+func WithLogger(l logger.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// WithBroker sets the broker served so several isolated
+// brokers can be served in one process
+func WithBroker(b broker.Broker) Option {
+	return func(o *Options) {
+		o.Broker = b
+	}
+}
+
+// WithNamespaces serves the namespaces of the manager selected by
+// path, header or client certificate
+func WithNamespaces(m *namespace.Manager) Option {
+	return func(o *Options) {
+		o.Namespaces = m
+	}
+}
+
+// WithUnaryInterceptor appends interceptors to the gRPC unary interceptor chain
+func WithUnaryInterceptor(i ...grpc.UnaryServerInterceptor) Option {
+	return func(o *Options) {
+		o.GRPC.UnaryInterceptors = append(o.GRPC.UnaryInterceptors, i...)
+	}
+}
+
+// WithStreamInterceptor appends interceptors to the gRPC stream interceptor chain
+func WithStreamInterceptor(i ...grpc.StreamServerInterceptor) Option {
+	return func(o *Options) {
+		o.GRPC.StreamInterceptors = append(o.GRPC.StreamInterceptors, i...)
+	}
+}
+
+// WithReflection registers the gRPC reflection service
+func WithReflection(b bool) Option {
+	return func(o *Options) {
+		o.GRPC.Reflection = b
+	}
+}
+
+// WithKeepalive sets the gRPC keepalive parameters
+func WithKeepalive(p keepalive.ServerParameters) Option {
+	return func(o *Options) {
+		o.GRPC.Keepalive = &p
+	}
+}
+
+// WithKeepalivePolicy sets the gRPC keepalive policy enforced on clients
+func WithKeepalivePolicy(p keepalive.EnforcementPolicy) Option {
+	return func(o *Options) {
+		o.GRPC.KeepalivePolicy = &p
+	}
+}
+
+// WithMaxConcurrentStreams limits the gRPC streams per connection
+func WithMaxConcurrentStreams(n uint32) Option {
+	return func(o *Options) {
+		o.GRPC.MaxConcurrentStreams = n
+	}
+}
@@ -1,6 +1,23 @@
 package server
 
+import (
+	"fmt"
+
+	"github.com/asim/emque/namespace"
+)
+
 type Server interface {
 	Run() error
 	Stop() error
 }
+
+// AllowAdmin returns an error unless the client certificate identity is one
+// of the admins. Anyone is allowed by * and no one if there are no admins.
+func AllowAdmin(admins []string, identity string) error {
+	for _, id := range admins {
+		if id == "*" || (len(identity) > 0 && id == identity) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: admin API", namespace.ErrForbidden)
+}
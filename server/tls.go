@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/asim/emque/logger"
+	"github.com/asim/emque/server/util"
+)
+
+var (
+	// ReloadInterval is how often certificate files are checked for changes
+	ReloadInterval = time.Second * 10
+)
+
+// TLSConfig returns the tls config for the server. Certificate files
+// are reloaded when changed on disk. A self signed certificate is
+// generated if none is specified, persisted to the cert dir if set.
+func TLSConfig(o *Options) (*tls.Config, error) {
+	config := new(tls.Config)
+
+	log := o.Logger
+	if log == nil {
+		log = logger.Default
+	}
+
+	switch {
+	case o.TLS != nil:
+		r, err := util.NewReloader(o.TLS.CertFile, o.TLS.KeyFile, ReloadInterval, func(cert tls.Certificate, err error) {
+			if err != nil {
+				log.Error("Failed to reload certificate", "cert_file", o.TLS.CertFile, "error", err)
+				return
+			}
+			log.Info("Reloaded certificate", "cert_file", o.TLS.CertFile, "fingerprint", util.Fingerprint(cert))
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Using certificate", "cert_file", o.TLS.CertFile, "fingerprint", util.Fingerprint(r.Certificate()))
+		config.GetCertificate = r.GetCertificate
+	default:
+		var cert tls.Certificate
+		var err error
+
+		if len(o.CertDir) > 0 {
+			// strip the port so the certificate is valid for the host
+			host, _, serr := net.SplitHostPort(o.Address)
+			if serr != nil {
+				host = o.Address
+			}
+			host, err = util.Address(host)
+			if err != nil {
+				return nil, err
+			}
+			cert, err = util.CA(o.CertDir, host, "localhost")
+		} else {
+			var addr string
+			addr, err = util.Address(o.Address)
+			if err != nil {
+				return nil, err
+			}
+			cert, err = util.Certificate(addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		log.Info("Using certificate", "fingerprint", util.Fingerprint(cert))
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	// no client auth
+	if o.ClientAuth == nil {
+		return config, nil
+	}
+
+	b, err := ioutil.ReadFile(o.ClientAuth.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", o.ClientAuth.CAFile)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+
+	if o.ClientAuth.Require {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asim/emque/client"
+	"github.com/asim/emque/server/util"
+)
+
+// clientCert writes a client certificate signed by the CA in dir
+func clientCert(t *testing.T, dir string) (string, string) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca, &priv.PublicKey, pair.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client-key.pem")
+
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPath, keyPath
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// server certificate for localhost signed by the CA
+	if _, err := util.CA(dir, "localhost", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile, keyFile := clientCert(t, dir)
+
+	config, err := TLSConfig(&Options{
+		TLS: &TLS{
+			CertFile: filepath.Join(dir, "cert.pem"),
+			KeyFile:  filepath.Join(dir, "key.pem"),
+		},
+		ClientAuth: &ClientAuth{
+			CAFile:  caFile,
+			Require: true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	}
+	go srv.Serve(tls.NewListener(l, config))
+	defer srv.Close()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	url := "https://localhost:" + port
+
+	get := func(opts client.Options) error {
+		config, err := client.TLSConfig(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: config},
+			Timeout:   time.Second * 5,
+		}
+		rsp, err := c.Get(url)
+		if err != nil {
+			return err
+		}
+		rsp.Body.Close()
+		return nil
+	}
+
+	testCases := []struct {
+		name    string
+		options client.Options
+		ok      bool
+		// fails verifying the server name
+		hostname bool
+	}{
+		{
+			name:    "no client certificate",
+			options: client.Options{CAFile: caFile},
+		},
+		{
+			name:    "signed client certificate",
+			options: client.Options{CAFile: caFile, CertFile: certFile, KeyFile: keyFile},
+			ok:      true,
+		},
+		{
+			name:     "server name mismatch",
+			options:  client.Options{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "example.com"},
+			hostname: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		err := get(tc.options)
+		if tc.ok && err != nil {
+			t.Fatalf("%s: expected request to succeed got %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Fatalf("%s: expected request to fail", tc.name)
+		}
+		var herr x509.HostnameError
+		if tc.hostname && !errors.As(err, &herr) {
+			t.Fatalf("%s: expected hostname error got %v", tc.name, err)
+		}
+	}
+}
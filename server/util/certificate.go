@@ -5,15 +5,32 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
+var (
+	// files persisted by CA
+	caFile    = "ca.pem"
+	caKeyFile = "ca-key.pem"
+	certFile  = "cert.pem"
+	keyFile   = "key.pem"
+
+	// reissue certificates expiring within this period
+	renewBefore = time.Hour * 24 * 30
+)
+
 func Certificate(host ...string) (tls.Certificate, error) {
 	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
@@ -23,8 +40,7 @@ func Certificate(host ...string) (tls.Certificate, error) {
 	notBefore := time.Now()
 	notAfter := notBefore.Add(time.Hour * 24 * 365)
 
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	serialNumber, err := serial()
 	if err != nil {
 		return tls.Certificate{}, err
 	}
@@ -42,13 +58,7 @@ func Certificate(host ...string) (tls.Certificate, error) {
 		BasicConstraintsValid: true,
 	}
 
-	for _, h := range host {
-		if ip := net.ParseIP(h); ip != nil {
-			template.IPAddresses = append(template.IPAddresses, ip)
-		} else {
-			template.DNSNames = append(template.DNSNames, h)
-		}
-	}
+	addHosts(&template, host...)
 
 	template.IsCA = true
 	template.KeyUsage |= x509.KeyUsageCertSign
@@ -58,6 +68,243 @@ func Certificate(host ...string) (tls.Certificate, error) {
 		return tls.Certificate{}, err
 	}
 
+	certPEM, keyPEM, err := encode(derBytes, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// CA loads a certificate from dir signed by a local CA. The CA and
+// certificate are generated and written to dir if they do not exist.
+// The certificate is reissued from the CA when close to expiry.
+func CA(dir string, host ...string) (tls.Certificate, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPath := filepath.Join(dir, certFile)
+	keyPath := filepath.Join(dir, keyFile)
+
+	// reuse the existing certificate
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Until(leaf.NotAfter) > renewBefore && hasHosts(leaf, host...) {
+			return cert, nil
+		}
+	}
+
+	ca, caKey, err := loadCA(dir)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serialNumber, err := serial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	notBefore := time.Now()
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Emque"},
+		},
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(time.Hour * 24 * 365),
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	addHosts(&template, host...)
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, ca, &priv.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM, keyPEM, err := encode(derBytes, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := writePair(certPath, certPEM, keyPath, keyPEM); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate
+func Fingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// loadCA loads the CA from dir or generates one if the CA certificate
+// does not exist. A key without a certificate is left from an interrupted
+// write and is replaced. Any other error is returned so an existing CA
+// clients trust is never overwritten.
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	caPath := filepath.Join(dir, caFile)
+	caKeyPath := filepath.Join(dir, caKeyFile)
+
+	if _, err := os.Stat(caPath); err == nil {
+		pair, err := tls.LoadX509KeyPair(caPath, caKeyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load CA: %v", err)
+		}
+		ca, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported CA key type in %s", caKeyPath)
+		}
+		return ca, key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := serial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notBefore := time.Now()
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"Emque"},
+			CommonName:   "Emque CA",
+		},
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(time.Hour * 24 * 365 * 10),
+
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM, keyPEM, err := encode(derBytes, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writePair(caPath, certPEM, caKeyPath, keyPEM); err != nil {
+		return nil, nil, err
+	}
+
+	ca, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ca, priv, nil
+}
+
+// writePair writes the key then the certificate, each to a temporary file
+// renamed into place, so a certificate is never paired with an old key
+func writePair(certPath string, certPEM []byte, keyPath string, keyPEM []byte) error {
+	for _, f := range []struct {
+		path string
+		data []byte
+	}{
+		{keyPath, keyPEM},
+		{certPath, certPEM},
+	} {
+		if err := ioutil.WriteFile(f.path+".tmp", f.data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(f.path+".tmp", f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasHosts returns true if the certificate is issued for exactly the hosts
+func hasHosts(cert *x509.Certificate, host ...string) bool {
+	var want x509.Certificate
+	addHosts(&want, host...)
+
+	if len(want.DNSNames) != len(cert.DNSNames) || len(want.IPAddresses) != len(cert.IPAddresses) {
+		return false
+	}
+	for _, name := range want.DNSNames {
+		if !contains(cert.DNSNames, name) {
+			return false
+		}
+	}
+	for _, ip := range want.IPAddresses {
+		var found bool
+		for _, cip := range cert.IPAddresses {
+			if ip.Equal(cip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func addHosts(template *x509.Certificate, host ...string) {
+	for _, h := range host {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+}
+
+func serial() (*big.Int, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, serialNumberLimit)
+}
+
+// encode returns the pem encoded certificate and private key
+func encode(derBytes []byte, priv *ecdsa.PrivateKey) ([]byte, []byte, error) {
 	// create public key
 	certOut := bytes.NewBuffer(nil)
 	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
@@ -66,9 +313,9 @@ func Certificate(host ...string) (tls.Certificate, error) {
 	keyOut := bytes.NewBuffer(nil)
 	b, err := x509.MarshalECPrivateKey(priv)
 	if err != nil {
-		return tls.Certificate{}, err
+		return nil, nil, err
 	}
 	pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
 
-	return tls.X509KeyPair(certOut.Bytes(), keyOut.Bytes())
+	return certOut.Bytes(), keyOut.Bytes(), nil
 }
@@ -0,0 +1,211 @@
+package util
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, err := CA(dir, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// certificate is reused across calls
+	again, err := CA(dir, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(cert) != Fingerprint(again) {
+		t.Fatal("expected certificate to be reused")
+	}
+
+	// certificate is signed by the CA
+	b, err := ioutil.ReadFile(filepath.Join(dir, caFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		t.Fatal("failed to load CA")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: pool}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCAHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, err := CA(dir, "localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		hosts  []string
+		reused bool
+	}{
+		{[]string{"127.0.0.1", "localhost"}, true},
+		{[]string{"example.com", "127.0.0.1"}, false},
+		{[]string{"example.com"}, false},
+	}
+
+	for _, tc := range testCases {
+		next, err := CA(dir, tc.hosts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reused := Fingerprint(next) == Fingerprint(cert); reused != tc.reused {
+			t.Fatalf("%v: expected reused %v got %v", tc.hosts, tc.reused, reused)
+		}
+		leaf, err := x509.ParseCertificate(next.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range tc.hosts {
+			if err := leaf.VerifyHostname(h); err != nil {
+				t.Fatalf("%v: %v", tc.hosts, err)
+			}
+		}
+		cert = next
+	}
+
+	// nothing is left from writing the files
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Fatalf("expected no temporary files got %v", files)
+	}
+}
+
+func TestCAExisting(t *testing.T) {
+	testCases := []struct {
+		name string
+		// modifies the CA files in the directory
+		change func(dir string) error
+		// a new CA is generated
+		generated bool
+	}{
+		{
+			name: "missing key",
+			change: func(dir string) error {
+				return os.Remove(filepath.Join(dir, caKeyFile))
+			},
+		},
+		{
+			name: "truncated certificate",
+			change: func(dir string) error {
+				return ioutil.WriteFile(filepath.Join(dir, caFile), []byte("-----BEGIN"), 0600)
+			},
+		},
+		{
+			name: "interrupted write",
+			change: func(dir string) error {
+				return os.Remove(filepath.Join(dir, caFile))
+			},
+			generated: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		dir, err := ioutil.TempDir("", "emque")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if _, err := CA(dir, "localhost"); err != nil {
+			t.Fatal(err)
+		}
+		// issue a new certificate from the CA
+		if err := os.Remove(filepath.Join(dir, certFile)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tc.change(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		before, _ := ioutil.ReadFile(filepath.Join(dir, caFile))
+
+		_, err = CA(dir, "localhost")
+		if tc.generated && err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !tc.generated && err == nil {
+			t.Fatalf("%s: expected error loading the CA", tc.name)
+		}
+
+		// an existing CA is never overwritten
+		after, _ := ioutil.ReadFile(filepath.Join(dir, caFile))
+		if changed := string(before) != string(after); changed != tc.generated {
+			t.Fatalf("%s: expected CA changed %v got %v", tc.name, tc.generated, changed)
+		}
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, err := CA(dir, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, certFile)
+	keyPath := filepath.Join(dir, keyFile)
+
+	r, err := NewReloader(certPath, keyPath, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fp := Fingerprint(r.Certificate()); fp != Fingerprint(cert) {
+		t.Fatalf("expected %s got %s", Fingerprint(cert), fp)
+	}
+
+	// remove the certificate so a new one is issued
+	os.Remove(certPath)
+	os.Remove(keyPath)
+
+	rotated, err := CA(dir, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ensure the modification time differs
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, future, future)
+
+	c, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp := Fingerprint(*c); fp != Fingerprint(rotated) {
+		t.Fatalf("expected %s got %s", Fingerprint(rotated), fp)
+	}
+}
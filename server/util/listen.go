@@ -0,0 +1,30 @@
+package util
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// IsUnix returns true if the address is a unix domain socket
+// of the form unix:///path/to/socket
+func IsUnix(addr string) bool {
+	return strings.HasPrefix(addr, "unix://")
+}
+
+// Listen announces on the address which may be a tcp
+// address or a unix domain socket
+func Listen(addr string) (net.Listener, error) {
+	if !IsUnix(addr) {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, "unix://")
+
+	// remove a stale socket left by a previous run
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate and key from disk and
+// reloads them when the files change. Existing connections
+// are unaffected, new handshakes use the latest certificate.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+	// called when the certificate is reloaded
+	notify func(tls.Certificate, error)
+}
+
+// NewReloader loads the certificate and key. The files are checked
+// for changes at most once per interval during handshakes.
+func NewReloader(certFile, keyFile string, interval time.Duration, notify func(tls.Certificate, error)) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+		notify:   notify,
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	r.cert = &cert
+	r.modTime = r.lastModified()
+	r.checked = time.Now()
+
+	return r, nil
+}
+
+// lastModified returns the latest modification time of the files
+func (r *Reloader) lastModified() time.Time {
+	var t time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// reload loads the certificate if the files changed
+func (r *Reloader) reload() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.checked = time.Now()
+
+	modTime := r.lastModified()
+	if modTime.Equal(r.modTime) {
+		return
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err == nil {
+		r.cert = &cert
+		// only mark as loaded on success so
+		// a partially written pair is retried
+		r.modTime = modTime
+	}
+
+	if r.notify != nil {
+		r.notify(cert, err)
+	}
+}
+
+// Certificate returns the current certificate
+func (r *Reloader) Certificate() tls.Certificate {
+	r.RLock()
+	defer r.RUnlock()
+	return *r.cert
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	stale := time.Since(r.checked) > r.interval
+	r.RUnlock()
+
+	if stale {
+		r.reload()
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
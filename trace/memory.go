@@ -0,0 +1,37 @@
+package trace
+
+import (
+	"sync"
+)
+
+// Memory is an exporter which keeps spans in memory
+type Memory struct {
+	sync.RWMutex
+	spans []*SpanData
+}
+
+// Export records the span
+func (m *Memory) Export(s *SpanData) {
+	m.Lock()
+	m.spans = append(m.spans, s)
+	m.Unlock()
+}
+
+// Spans returns the recorded spans
+func (m *Memory) Spans() []*SpanData {
+	m.RLock()
+	defer m.RUnlock()
+	return append([]*SpanData(nil), m.spans...)
+}
+
+// Reset deletes the recorded spans
+func (m *Memory) Reset() {
+	m.Lock()
+	m.spans = nil
+	m.Unlock()
+}
+
+// NewMemory returns an in-memory exporter
+func NewMemory() *Memory {
+	return new(Memory)
+}
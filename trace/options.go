@@ -0,0 +1,16 @@
+package trace
+
+type Options struct {
+	// Exporter receives ended spans. Spans are
+	// not recorded if no exporter is set.
+	Exporter Exporter
+}
+
+type Option func(o *Options)
+
+// WithExporter sets the exporter of ended spans
+func WithExporter(e Exporter) Option {
+	return func(o *Options) {
+		o.Exporter = e
+	}
+}
@@ -0,0 +1,271 @@
+// Package trace propagates W3C trace context through messages
+// and records spans via a pluggable Tracer.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TraceparentHeader is the W3C trace context header
+	TraceparentHeader = "traceparent"
+	// TracestateHeader is the W3C vendor specific trace state header
+	TracestateHeader = "tracestate"
+)
+
+var (
+	// Default tracer propagates trace context without recording spans
+	Default = New()
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	State   string
+}
+
+// Span is a unit of work within a trace
+type Span interface {
+	// Context of the span to propagate
+	Context() SpanContext
+	SetAttribute(key, value string)
+	SetError(err error)
+	End()
+}
+
+// Tracer starts spans
+type Tracer interface {
+	// Start starts a span which is a child of the span in the context
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Exporter receives ended spans
+type Exporter interface {
+	Export(s *SpanData)
+}
+
+// SpanData is a recorded span
+type SpanData struct {
+	Name       string
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+type contextKey struct{}
+
+// internal tracer
+type tracer struct {
+	options Options
+}
+
+// internal span
+type span struct {
+	tracer *tracer
+	ctx    SpanContext
+	data   *SpanData
+
+	sync.Mutex
+	ended bool
+}
+
+// IsValid returns true if the trace and span id are set
+func (s SpanContext) IsValid() bool {
+	return s.TraceID != [16]byte{} && s.SpanID != [8]byte{}
+}
+
+// Traceparent returns the W3C traceparent header value
+func (s SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(s.TraceID[:]), hex.EncodeToString(s.SpanID[:]), s.Flags)
+}
+
+// Parse parses a W3C traceparent header value
+func Parse(traceparent string) (SpanContext, error) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, errors.New("invalid traceparent")
+	}
+	// version 00 has exactly four parts
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, errors.New("invalid traceparent")
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errors.New("invalid traceparent")
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, err
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, err
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, err
+	}
+	sc.Flags = flags[0]
+
+	if !sc.IsValid() {
+		return sc, errors.New("invalid traceparent")
+	}
+
+	return sc, nil
+}
+
+// Inject sets the trace context headers for the span context
+func Inject(sc SpanContext, headers map[string]string) {
+	if !sc.IsValid() || headers == nil {
+		return
+	}
+	headers[TraceparentHeader] = sc.Traceparent()
+	if len(sc.State) > 0 {
+		headers[TracestateHeader] = sc.State
+	} else {
+		delete(headers, TracestateHeader)
+	}
+}
+
+// Extract returns the span context from the trace context headers
+func Extract(headers map[string]string) (SpanContext, bool) {
+	v, ok := headers[TraceparentHeader]
+	if !ok {
+		return SpanContext{}, false
+	}
+	sc, err := Parse(v)
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.State = headers[TracestateHeader]
+	return sc, true
+}
+
+// ExtractContext returns a context carrying the span context from the headers
+func ExtractContext(ctx context.Context, headers map[string]string) context.Context {
+	if sc, ok := Extract(headers); ok {
+		return NewContext(ctx, sc)
+	}
+	return ctx
+}
+
+// NewContext returns a context carrying the span context
+func NewContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context carried by the context
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+func (t *tracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	parent, ok := FromContext(ctx)
+
+	// without an exporter the parent is propagated as is
+	if t.options.Exporter == nil {
+		return ctx, &span{ctx: parent, ended: true}
+	}
+
+	sc := SpanContext{
+		TraceID: parent.TraceID,
+		Flags:   parent.Flags,
+		State:   parent.State,
+	}
+
+	// start a new sampled trace
+	if !ok {
+		rand.Read(sc.TraceID[:])
+		sc.Flags = 0x01
+	}
+	rand.Read(sc.SpanID[:])
+
+	data := &SpanData{
+		Name:       name,
+		TraceID:    hex.EncodeToString(sc.TraceID[:]),
+		SpanID:     hex.EncodeToString(sc.SpanID[:]),
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+	}
+	if ok {
+		data.ParentID = hex.EncodeToString(parent.SpanID[:])
+	}
+
+	s := &span{
+		tracer: t,
+		ctx:    sc,
+		data:   data,
+	}
+
+	return NewContext(ctx, sc), s
+}
+
+func (s *span) Context() SpanContext {
+	return s.ctx
+}
+
+func (s *span) SetAttribute(key, value string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.ended {
+		return
+	}
+	s.data.Error = err.Error()
+}
+
+func (s *span) End() {
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	s.Unlock()
+
+	s.tracer.options.Exporter.Export(s.data)
+}
+
+// New returns a Tracer
+func New(opts ...Option) Tracer {
+	var options Options
+	for _, o := range opts {
+		o(&options)
+	}
+	return &tracer{options: options}
+}
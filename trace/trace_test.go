@@ -0,0 +1,83 @@
+package trace
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, err := Parse(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Traceparent() != tp {
+		t.Fatalf("expected %s got %s", tp, sc.Traceparent())
+	}
+
+	for _, v := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, err := Parse(v); err == nil {
+			t.Fatalf("expected error parsing %q", v)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	mem := NewMemory()
+	tr := New(WithExporter(mem))
+
+	headers := map[string]string{
+		TraceparentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		TracestateHeader:  "foo=bar",
+	}
+
+	ctx, span := tr.Start(ExtractContext(context.Background(), headers), "publish")
+	_, child := tr.Start(ctx, "deliver")
+	child.End()
+	span.End()
+
+	spans := mem.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans got %d", len(spans))
+	}
+
+	deliver, publish := spans[0], spans[1]
+	if publish.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || publish.ParentID != "00f067aa0ba902b7" {
+		t.Fatalf("publish span not a child of the remote span: %+v", publish)
+	}
+	if deliver.TraceID != publish.TraceID || deliver.ParentID != publish.SpanID {
+		t.Fatalf("deliver span not a child of publish: %+v", deliver)
+	}
+
+	out := make(map[string]string)
+	Inject(span.Context(), out)
+	if out[TracestateHeader] != "foo=bar" {
+		t.Fatalf("expected tracestate to be propagated got %v", out)
+	}
+	if sc, ok := Extract(out); !ok || sc != span.Context() {
+		t.Fatalf("expected %v got %v", span.Context(), sc)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	// the default tracer propagates the parent as is
+	ctx, span := Default.Start(context.Background(), "publish")
+	if span.Context().IsValid() {
+		t.Fatal("expected no span context")
+	}
+	span.End()
+
+	sc, _ := Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, span = Default.Start(NewContext(ctx, sc), "publish")
+	if span.Context() != sc {
+		t.Fatalf("expected %v got %v", sc, span.Context())
+	}
+}
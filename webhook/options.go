@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"net/http"
+
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/logger"
+)
+
+type Options struct {
+	// Broker subscribed to. Defaults to broker.Default
+	Broker broker.Broker
+	// Client used to deliver messages
+	Client *http.Client
+	// Logger for messages lost dead lettering
+	Logger logger.Logger
+	// File webhooks are saved to and registered from
+	// on start. Webhooks are held in memory if empty.
+	File string
+	// Messages queued per webhook waiting for delivery.
+	// Messages which overflow the queue are dead lettered.
+	QueueSize int
+}
+
+type Option func(o *Options)
+
+// Broker sets the broker subscribed to
+func Broker(b broker.Broker) Option {
+	return func(o *Options) {
+		o.Broker = b
+	}
+}
+
+// Client sets the http client used to deliver messages
+func Client(c *http.Client) Option {
+	return func(o *Options) {
+		o.Client = c
+	}
+}
+
+// Logger sets the logger
+func Logger(l logger.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// File sets the file webhooks are saved to
+func File(f string) Option {
+	return func(o *Options) {
+		o.File = f
+	}
+}
+
+// QueueSize sets the number of messages queued per webhook
+func QueueSize(n int) Option {
+	return func(o *Options) {
+		o.QueueSize = n
+	}
+}
@@ -0,0 +1,574 @@
+// Package webhook pushes messages to HTTP endpoints
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asim/emque/broker"
+	"github.com/asim/emque/logger"
+)
+
+var (
+	// Header containing the HMAC-SHA256 signature of the body
+	SignatureHeader = "X-Emque-Signature"
+	// Header containing the topic of the messages
+	TopicHeader = "X-Emque-Topic"
+	// Header containing the original id of a dead letter
+	IdHeader = "X-Emque-Id"
+)
+
+// Webhook pushes messages published to a topic to a URL.
+// Messages are delivered as a JSON array via POST.
+type Webhook struct {
+	Id    string `json:"id"`
+	Topic string `json:"topic"`
+	URL   string `json:"url"`
+	// Headers added to each request
+	Headers map[string]string `json:"headers,omitempty"`
+	// Secret used to sign the body
+	Secret string `json:"secret,omitempty"`
+	// Max number of messages per request
+	BatchSize int `json:"batch_size"`
+	// Number of retries before sending to the dead letter topic
+	MaxRetries int `json:"max_retries"`
+	// Initial backoff between retries, doubled on each retry
+	Backoff Duration `json:"backoff"`
+	// Max backoff between retries
+	MaxBackoff Duration `json:"max_backoff"`
+	// Topic messages are published to once retries are exhausted
+	DeadLetter string `json:"dead_letter"`
+}
+
+// Status is the delivery status of a webhook
+type Status struct {
+	*Webhook
+	Delivered    int64      `json:"delivered"`
+	Failed       int64      `json:"failed"`
+	DeadLettered int64      `json:"dead_lettered"`
+	Dropped      int64      `json:"dropped"`
+	Overflowed   int64      `json:"overflowed"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastDelivery *time.Time `json:"last_delivery,omitempty"`
+}
+
+// Duration is a time.Duration encoded as a string e.g 1s
+type Duration time.Duration
+
+// Manager delivers messages to registered webhooks
+type Manager struct {
+	options Options
+
+	sync.RWMutex
+	hooks map[string]*hook
+}
+
+// internal registered webhook
+type hook struct {
+	*Webhook
+	exit chan bool
+	wg   sync.WaitGroup
+	// messages waiting to be delivered
+	queue chan *broker.Message
+
+	delivered    int64
+	failed       int64
+	deadLettered int64
+	dropped      int64
+	overflowed   int64
+
+	mtx          sync.RWMutex
+	lastError    string
+	lastDelivery *time.Time
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Sign returns the signature of the body using the secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns true if the signature of the body is valid
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+func newId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (m *Manager) broker() broker.Broker {
+	if m.options.Broker != nil {
+		return m.options.Broker
+	}
+	return broker.Default
+}
+
+// send posts the batch to the webhook
+func (m *Manager) send(h *hook, msgs []*broker.Message) error {
+	body, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TopicHeader, h.Topic)
+
+	if len(h.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(h.Secret, body))
+	}
+
+	rsp, err := m.options.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("Non 2xx response %d", rsp.StatusCode)
+	}
+
+	return nil
+}
+
+// deadLetter publishes the message to the dead letter topic with its
+// headers, original id and topic. Dead letters are buffered so they
+// can be fetched without a subscriber.
+func (m *Manager) deadLetter(h *hook, msg *broker.Message) {
+	headers := make(map[string]string, len(msg.Headers)+2)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[IdHeader] = strconv.FormatInt(msg.Id, 10)
+	headers[TopicHeader] = msg.Topic
+
+	err := m.broker().Publish(h.DeadLetter, msg.Payload,
+		broker.Headers(headers),
+		broker.Buffered(true),
+	)
+	if err != nil {
+		atomic.AddInt64(&h.dropped, 1)
+		m.options.Logger.Error("Failed to dead letter message", "webhook", h.Id, "topic", h.DeadLetter, "error", err)
+		return
+	}
+	atomic.AddInt64(&h.deadLettered, 1)
+}
+
+// deliver sends the batch retrying with backoff. Messages are
+// published to the dead letter topic once retries are exhausted.
+func (m *Manager) deliver(h *hook, msgs []*broker.Message) {
+	backoff := time.Duration(h.Backoff)
+
+	for i := 0; i <= h.MaxRetries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-h.exit:
+				return
+			}
+			backoff *= 2
+			if backoff > time.Duration(h.MaxBackoff) {
+				backoff = time.Duration(h.MaxBackoff)
+			}
+		}
+
+		err := m.send(h, msgs)
+		if err == nil {
+			atomic.AddInt64(&h.delivered, int64(len(msgs)))
+			now := time.Now()
+			h.mtx.Lock()
+			h.lastDelivery = &now
+			h.mtx.Unlock()
+			return
+		}
+
+		atomic.AddInt64(&h.failed, 1)
+		h.mtx.Lock()
+		h.lastError = err.Error()
+		h.mtx.Unlock()
+	}
+
+	// retries exhausted
+	for _, msg := range msgs {
+		m.deadLetter(h, msg)
+	}
+}
+
+// receive queues messages from the subscription so it is never blocked
+// by deliveries. Messages which overflow the queue are dead lettered.
+func (m *Manager) receive(h *hook, ch <-chan *broker.Message) {
+	defer h.wg.Done()
+	defer close(h.queue)
+	defer m.broker().UnsubscribeMessages(h.Topic, ch)
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			select {
+			case h.queue <- msg:
+			default:
+				atomic.AddInt64(&h.overflowed, 1)
+				m.deadLetter(h, msg)
+			}
+		case <-h.exit:
+			return
+		}
+	}
+}
+
+// run delivers queued messages in batches
+func (m *Manager) run(h *hook) {
+	defer h.wg.Done()
+
+	for {
+		var msgs []*broker.Message
+
+		select {
+		case msg, ok := <-h.queue:
+			if !ok {
+				return
+			}
+			msgs = append(msgs, msg)
+		case <-h.exit:
+			return
+		}
+
+		// batch whatever else is available
+	batch:
+		for len(msgs) < h.BatchSize {
+			select {
+			case msg, ok := <-h.queue:
+				if !ok {
+					break batch
+				}
+				msgs = append(msgs, msg)
+			default:
+				break batch
+			}
+		}
+
+		m.deliver(h, msgs)
+	}
+}
+
+func (h *hook) status() *Status {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	w := *h.Webhook
+	// never expose the secret
+	if len(w.Secret) > 0 {
+		w.Secret = "********"
+	}
+
+	return &Status{
+		Webhook:      &w,
+		Delivered:    atomic.LoadInt64(&h.delivered),
+		Failed:       atomic.LoadInt64(&h.failed),
+		DeadLettered: atomic.LoadInt64(&h.deadLettered),
+		Dropped:      atomic.LoadInt64(&h.dropped),
+		Overflowed:   atomic.LoadInt64(&h.overflowed),
+		LastError:    h.lastError,
+		LastDelivery: h.lastDelivery,
+	}
+}
+
+// validate checks the webhook and sets defaults
+func validate(w *Webhook) error {
+	if len(w.Topic) == 0 {
+		return errors.New("topic not specified")
+	}
+
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("invalid url")
+	}
+
+	if len(w.Id) == 0 {
+		w.Id = newId()
+	}
+	if w.BatchSize <= 0 {
+		w.BatchSize = 1
+	}
+	if w.MaxRetries < 0 {
+		w.MaxRetries = 0
+	}
+	if w.Backoff <= 0 {
+		w.Backoff = Duration(time.Second)
+	}
+	if w.MaxBackoff < w.Backoff {
+		w.MaxBackoff = Duration(time.Minute)
+	}
+	if len(w.DeadLetter) == 0 {
+		w.DeadLetter = w.Topic + ".dead"
+	}
+	return nil
+}
+
+// start subscribes to the topic and starts delivering
+// messages. Must be called with the manager locked.
+func (m *Manager) start(w *Webhook) (*hook, error) {
+	if _, ok := m.hooks[w.Id]; ok {
+		return nil, fmt.Errorf("webhook %s already exists", w.Id)
+	}
+
+	ch, err := m.broker().SubscribeMessages(w.Topic, broker.Metadata(map[string]string{
+		"transport": "webhook",
+		"remote":    w.URL,
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	h := &hook{
+		Webhook: w,
+		exit:    make(chan bool),
+		queue:   make(chan *broker.Message, m.options.QueueSize),
+	}
+
+	h.wg.Add(2)
+	go m.receive(h, ch)
+	go m.run(h)
+
+	m.hooks[w.Id] = h
+	return h, nil
+}
+
+func (h *hook) stop() {
+	close(h.exit)
+	h.wg.Wait()
+}
+
+// save writes the registered webhooks. Must be called with the manager locked.
+func (m *Manager) save() error {
+	if len(m.options.File) == 0 {
+		return nil
+	}
+
+	list := []*Webhook{}
+	for _, h := range m.hooks {
+		list = append(list, h.Webhook)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+
+	b, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.options.File), 0700); err != nil {
+		return err
+	}
+
+	// replace the file atomically
+	tmp := m.options.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.options.File)
+}
+
+// load registers the saved webhooks
+func (m *Manager) load() error {
+	if len(m.options.File) == 0 {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(m.options.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []*Webhook
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, w := range list {
+		if err := validate(w); err != nil {
+			continue
+		}
+		if _, err := m.start(w); err != nil {
+			m.options.Logger.Error("Failed to register webhook", "webhook", w.Id, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// Register validates the webhook and starts delivering messages
+func (m *Manager) Register(w *Webhook) error {
+	if err := validate(w); err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	h, err := m.start(w)
+	if err != nil {
+		return err
+	}
+
+	if err := m.save(); err != nil {
+		delete(m.hooks, w.Id)
+		h.stop()
+		return err
+	}
+
+	return nil
+}
+
+// Deregister stops delivering messages to the webhook
+func (m *Manager) Deregister(id string) error {
+	m.Lock()
+	h, ok := m.hooks[id]
+	delete(m.hooks, id)
+	var err error
+	if ok {
+		err = m.save()
+	}
+	m.Unlock()
+
+	if !ok {
+		return fmt.Errorf("webhook %s not found", id)
+	}
+
+	h.stop()
+	return err
+}
+
+// Get returns the status of the webhook
+func (m *Manager) Get(id string) (*Status, error) {
+	m.RLock()
+	h, ok := m.hooks[id]
+	m.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("webhook %s not found", id)
+	}
+
+	return h.status(), nil
+}
+
+// List returns the status of all webhooks
+func (m *Manager) List() []*Status {
+	m.RLock()
+	var list []*Status
+	for _, h := range m.hooks {
+		list = append(list, h.status())
+	}
+	m.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+
+	return list
+}
+
+// Close stops delivering messages to all webhooks. Saved
+// webhooks are registered again by the next manager.
+func (m *Manager) Close() error {
+	m.Lock()
+	hooks := m.hooks
+	m.hooks = make(map[string]*hook)
+	m.Unlock()
+
+	for _, h := range hooks {
+		h.stop()
+	}
+	return nil
+}
+
+// New returns a webhook manager registering the saved webhooks
+func New(opts ...Option) *Manager {
+	options := Options{
+		Client: &http.Client{
+			Timeout: time.Second * 30,
+		},
+		QueueSize: 1000,
+	}
+
+	for _, o := range opts {
+		o(&options)
+	}
+
+	if options.Logger == nil {
+		options.Logger = logger.Default
+	}
+
+	if options.QueueSize <= 0 {
+		options.QueueSize = 1000
+	}
+
+	m := &Manager{
+		options: options,
+		hooks:   make(map[string]*hook),
+	}
+
+	// the file is left as is for inspection
+	if err := m.load(); err != nil {
+		m.options.Logger.Error("Failed to load webhooks", "file", options.File, "error", err)
+		m.options.File = ""
+	}
+
+	return m
+}
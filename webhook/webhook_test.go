@@ -0,0 +1,304 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/asim/emque/broker"
+)
+
+func TestDeliver(t *testing.T) {
+	received := make(chan []*broker.Message, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !Verify("secret", body, r.Header.Get(SignatureHeader)) {
+			t.Error("invalid signature")
+		}
+		if r.Header.Get("X-Test") != "test" {
+			t.Error("expected header X-Test")
+		}
+		var msgs []*broker.Message
+		if err := json.Unmarshal(body, &msgs); err != nil {
+			t.Error(err)
+		}
+		received <- msgs
+	}))
+	defer srv.Close()
+
+	b := broker.New()
+	defer b.Close()
+
+	m := New(Broker(b))
+	defer m.Close()
+
+	err := m.Register(&Webhook{
+		Topic:   "deliver",
+		URL:     srv.URL,
+		Headers: map[string]string{"X-Test": "test"},
+		Secret:  "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("deliver", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msgs := <-received:
+		if len(msgs) != 1 || string(msgs[0].Payload) != "foo" {
+			t.Fatalf("unexpected messages %v", msgs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	b := broker.New()
+	defer b.Close()
+
+	dead, err := b.SubscribeMessages("fail.dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(Broker(b))
+	defer m.Close()
+
+	hook := &Webhook{
+		Topic:      "fail",
+		URL:        srv.URL,
+		MaxRetries: 2,
+		Backoff:    Duration(time.Millisecond),
+	}
+
+	if err := m.Register(hook); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("fail", []byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-dead:
+		if string(msg.Payload) != "foo" {
+			t.Fatalf("expected foo got %s", string(msg.Payload))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for dead letter")
+	}
+
+	status, err := m.Get(hook.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Failed != 3 {
+		t.Fatalf("expected 3 failed attempts got %d", status.Failed)
+	}
+}
+
+func TestDeadLetterFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	b := broker.New()
+	defer b.Close()
+
+	m := New(Broker(b))
+	defer m.Close()
+
+	hook := &Webhook{
+		Topic:   "fail",
+		URL:     srv.URL,
+		Backoff: Duration(time.Millisecond),
+	}
+
+	if err := m.Register(hook); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Publish("fail", []byte("foo"), broker.Headers(map[string]string{"X-Test": "test"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing subscribes to the dead letter topic
+	for i := 0; ; i++ {
+		status, err := m.Get(hook.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.DeadLettered == 1 {
+			break
+		}
+		if i > 100 {
+			t.Fatal("timed out waiting for dead letter")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	msgs, err := b.Fetch("fail.dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || string(msgs[0].Payload) != "foo" {
+		t.Fatalf("expected dead letter foo got %v", msgs)
+	}
+	// the original message is forwarded
+	for k, v := range map[string]string{"X-Test": "test", IdHeader: "1", TopicHeader: "fail"} {
+		if msgs[0].Headers[k] != v {
+			t.Fatalf("expected header %s %s got %v", k, v, msgs[0].Headers)
+		}
+	}
+
+	status, err := m.Get(hook.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Dropped != 0 {
+		t.Fatalf("expected no dropped messages got %d", status.Dropped)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	release := make(chan bool)
+	received := make(chan bool, 10)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- true
+		<-release
+	}))
+	defer srv.Close()
+
+	b := broker.New()
+	defer b.Close()
+
+	m := New(Broker(b), QueueSize(1))
+	defer m.Close()
+
+	// unblocks deliveries before closing
+	defer close(release)
+
+	hook := &Webhook{
+		Topic: "slow",
+		URL:   srv.URL,
+	}
+
+	if err := m.Register(hook); err != nil {
+		t.Fatal(err)
+	}
+
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := b.Publish("slow", []byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// one delivery in flight, one queued and the rest overflow
+	publish(1)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+	publish(9)
+
+	var status *Status
+	for i := 0; ; i++ {
+		var err error
+		status, err = m.Get(hook.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Overflowed+2 == 10 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("expected 8 messages to overflow got %d", status.Overflowed)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if status.DeadLettered != status.Overflowed {
+		t.Fatalf("expected %d dead letters got %d", status.Overflowed, status.DeadLettered)
+	}
+
+	msgs, err := b.Fetch("slow.dead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 8 {
+		t.Fatalf("expected 8 dead letters got %d", len(msgs))
+	}
+	for _, m := range msgs {
+		if m.Headers[TopicHeader] != "slow" || len(m.Headers[IdHeader]) == 0 {
+			t.Fatalf("expected original topic and id got %v", m.Headers)
+		}
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "emque")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "webhooks.json")
+
+	b := broker.New()
+	defer b.Close()
+
+	m := New(Broker(b), File(file))
+	hook := &Webhook{
+		Topic:  "foo",
+		URL:    "http://localhost:8080",
+		Secret: "secret",
+	}
+	if err := m.Register(hook); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	// registered again from the file
+	m = New(Broker(b), File(file))
+	defer m.Close()
+
+	list := m.List()
+	if len(list) != 1 || list[0].Id != hook.Id || list[0].Topic != "foo" {
+		t.Fatalf("expected webhook %s got %v", hook.Id, list)
+	}
+	if info, err := b.Describe("foo"); err != nil || len(info.Subscribers) != 1 {
+		t.Fatalf("expected webhook to subscribe got %v %v", info, err)
+	}
+
+	if err := m.Deregister(hook.Id); err != nil {
+		t.Fatal(err)
+	}
+	if m := New(Broker(b), File(file)); len(m.List()) != 0 {
+		t.Fatalf("expected no webhooks got %d", len(m.List()))
+	}
+}